@@ -0,0 +1,214 @@
+//go:build linux
+// +build linux
+
+// Command fanotify watches a directory, or the mount or filesystem it
+// belongs to, and prints the events reported for it.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/r00tu53r/fanotify"
+	"golang.org/x/sys/unix"
+)
+
+var (
+	watchDir     string
+	watchMount   bool
+	watchFS      bool
+	noFollow     bool
+	watchEvents  string
+	outputFormat string
+	logFormat    string
+	debug        bool
+)
+
+func init() {
+	flag.StringVar(&watchDir, "watchdir", "", "path to directory to be watched")
+	flag.BoolVar(&watchMount, "mount", false, "watch the entire mount containing watchdir")
+	flag.BoolVar(&watchFS, "filesystem", false, "watch the entire filesystem containing watchdir")
+	flag.BoolVar(&noFollow, "nofollow", false, "if watchdir is a symlink, watch the link itself rather than its target")
+	flag.StringVar(&watchEvents, "events", "", "comma separated list of events to watch, e.g. open,modify,close-write")
+	flag.StringVar(&outputFormat, "format", "text", "output format of events, text or json")
+	flag.StringVar(&logFormat, "log-format", "text", "format of the log written to stderr, text or json")
+	flag.BoolVar(&debug, "debug", false, "log how each event is decoded")
+}
+
+func usage() {
+	fmt.Printf("%s -watchdir /directory/to/monitor [-mount | -filesystem] [-nofollow] [-events open,modify,...] [-format text|json] [-log-format text|json] [-debug]\n", os.Args[0])
+}
+
+func main() {
+	flag.Parse()
+	if watchDir == "" || watchMount && watchFS || outputFormat != "text" && outputFormat != "json" ||
+		logFormat != "text" && logFormat != "json" {
+		usage()
+		os.Exit(1)
+	}
+	hopts := &slog.HandlerOptions{Level: slog.LevelInfo}
+	if debug {
+		hopts.Level = slog.LevelDebug
+	}
+	if logFormat == "json" {
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, hopts)))
+	} else {
+		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, hopts)))
+	}
+	var markFlags uint
+	if watchMount {
+		markFlags |= unix.FAN_MARK_MOUNT
+	}
+	if watchFS {
+		markFlags |= unix.FAN_MARK_FILESYSTEM
+	}
+	if noFollow {
+		markFlags |= unix.FAN_MARK_DONT_FOLLOW
+	}
+	var mask uint64
+	if watchEvents != "" {
+		var err error
+		mask, err = fanotify.MaskFromStrings(strings.Split(watchEvents, ","))
+		if err != nil {
+			fmt.Println(err)
+			usage()
+			os.Exit(1)
+		}
+	}
+	// interrupting the tool is the normal way to stop it
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, unix.SIGTERM)
+	defer stop()
+	if err := watch(ctx, watchDir, markFlags, mask, outputFormat); err != nil {
+		slog.Error(err.Error())
+		stop()
+		os.Exit(1)
+	}
+}
+
+// watch watches only the specified directory, or with FAN_MARK_MOUNT or
+// FAN_MARK_FILESYSTEM in markFlags every file of the mount, respectively
+// the filesystem, the directory belongs to.
+//
+// A directory mark reports events for the directory and its immediate
+// children only, so changes deeper in the tree go unnoticed. A mount mark
+// covers every file of the mount at any depth but does not support the
+// directory entry events of fanotify.FileDeleteSelf, hence open/exec
+// events are watched instead.
+//
+// A non-zero mask overrides the events of the presets. With format "json"
+// each event is written to stdout as a JSON object on a line of its own,
+// otherwise it is logged with its path, mask and pid as attributes.
+//
+// watch returns nil once ctx is cancelled, or the error that stopped the
+// watcher.
+func watch(ctx context.Context, watchDir string, markFlags uint, mask uint64, format string) error {
+	opts := fanotify.WatchOptions{MarkFlags: markFlags, Mask: mask, Logger: logger{}}
+	switch {
+	case mask != 0:
+		// the init flags are derived from the mask
+	case markFlags&unix.FAN_MARK_MOUNT != 0:
+		opts.Flags, opts.Mask = fanotify.FileOpenExec()
+	default:
+		opts.Flags, opts.Mask = fanotify.FileDeleteSelf()
+	}
+	w, err := fanotify.NewWatcherWithOptions(watchDir, opts)
+	if err != nil {
+		return fmt.Errorf("NewWatcher: %w", err)
+	}
+	defer w.Close()
+
+	slog.Info("listening", "path", watchDir, "mask", fanotify.MaskValues(opts.Mask))
+	for _, d := range fanotify.MaskDescriptions(opts.Mask) {
+		slog.Info(d)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	events := w.Events()
+	for {
+		var ev fanotify.Event
+		select {
+		case <-ctx.Done():
+			return nil
+		case e, ok := <-events:
+			if !ok {
+				if err := w.Err(); err != nil {
+					return fmt.Errorf("Watcher: %w", err)
+				}
+				return nil
+			}
+			ev = e
+		}
+		switch {
+		case format == "json":
+			if err := enc.Encode(jsonEvent{
+				Seq:        ev.Seq,
+				Path:       ev.Path,
+				MountPoint: ev.MountPoint,
+				Mask:       ev.Mask,
+				MaskNames:  ev.Values,
+				Pid:        ev.Pid,
+				Time:       ev.Time,
+			}); err != nil {
+				ev.Close()
+				return fmt.Errorf("Encode: %w", err)
+			}
+		case ev.Overflow:
+			logEvent(ctx, ev, slog.LevelWarn, "event queue overflowed, events were lost")
+		default:
+			logEvent(ctx, ev, slog.LevelInfo, "event",
+				slog.String("path", ev.Path),
+				slog.Any("mask", ev.Values),
+				slog.Int("pid", int(ev.Pid)))
+		}
+		if ev.ResponseRequired {
+			// the tool only monitors, never blocks the access
+			if err := w.Respond(ev.Fd, true); err != nil {
+				slog.Error("respond", "err", err)
+			}
+		}
+		ev.Close()
+	}
+}
+
+// logEvent logs msg with attrs at level, timestamped with the time ev was
+// read rather than the time it is logged.
+func logEvent(ctx context.Context, ev fanotify.Event, level slog.Level, msg string, attrs ...slog.Attr) {
+	h := slog.Default().Handler()
+	if !h.Enabled(ctx, level) {
+		return
+	}
+	r := slog.NewRecord(ev.Time, level, msg, 0)
+	r.AddAttrs(attrs...)
+	h.Handle(ctx, r)
+}
+
+// jsonEvent is the representation of an event written with -format json.
+type jsonEvent struct {
+	Seq        uint64    `json:"seq"`
+	Path       string    `json:"path"`
+	MountPoint string    `json:"mountPoint,omitempty"`
+	Mask       uint64    `json:"mask"`
+	MaskNames  []string  `json:"maskNames"`
+	Pid        int32     `json:"pid"`
+	Time       time.Time `json:"time"`
+}
+
+// logger passes the diagnostics of the watcher to the default slog logger,
+// the per event tracing only with -debug.
+type logger struct{}
+
+func (logger) Debugf(format string, v ...interface{}) {
+	if slog.Default().Enabled(context.Background(), slog.LevelDebug) {
+		slog.Debug(fmt.Sprintf(format, v...))
+	}
+}
+
+func (logger) Errorf(format string, v ...interface{}) {
+	slog.Error(fmt.Sprintf(format, v...))
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/r00tu53r/fanotify"
+)
+
+func main() {
+	fmt.Fprintln(os.Stderr, fanotify.ErrUnsupportedPlatform)
+	os.Exit(1)
+}
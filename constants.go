@@ -0,0 +1,125 @@
+package fanotify
+
+// The fanotify(7) flags and event bits used by the code shared with the
+// other platforms, on which golang.org/x/sys/unix does not define them. The
+// values are those of the kernel ABI, the same on every architecture.
+
+// Event mask bits.
+const (
+	fanAccess       = 0x1
+	fanModify       = 0x2
+	fanAttrib       = 0x4
+	fanCloseWrite   = 0x8
+	fanCloseNoWrite = 0x10
+	fanOpen         = 0x20
+	fanMovedFrom    = 0x40
+	fanMovedTo      = 0x80
+	fanCreate       = 0x100
+	fanDelete       = 0x200
+	fanDeleteSelf   = 0x400
+	fanMoveSelf     = 0x800
+	fanOpenExec     = 0x1000
+	fanQOverflow    = 0x4000
+	fanFSError      = 0x8000
+	fanOpenPerm     = 0x10000
+	fanAccessPerm   = 0x20000
+	fanOpenExecPerm = 0x40000
+	fanEventOnChild = 0x8000000
+	fanRename       = 0x10000000
+	fanOnDir        = 0x40000000
+
+	fanClose = fanCloseWrite | fanCloseNoWrite
+	fanMove  = fanMovedFrom | fanMovedTo
+)
+
+// fanotify_init flags.
+const (
+	fanCloexec         = 0x1
+	fanNonblock        = 0x2
+	fanClassNotif      = 0x0
+	fanClassContent    = 0x4
+	fanClassPreContent = 0x8
+	fanAllClassBits    = fanClassNotif | fanClassContent | fanClassPreContent
+	fanUnlimitedQueue  = 0x10
+	fanUnlimitedMarks  = 0x20
+	fanEnableAudit     = 0x40
+	fanReportPidfd     = 0x80
+	fanReportTID       = 0x100
+	fanReportFID       = 0x200
+	fanReportDirFID    = 0x400
+	fanReportName      = 0x800
+	fanReportTargetFID = 0x1000
+	fanReportDFIDName  = fanReportDirFID | fanReportName
+)
+
+// fanotify_mark flags.
+const (
+	fanMarkAdd               = 0x1
+	fanMarkRemove            = 0x2
+	fanMarkDontFollow        = 0x4
+	fanMarkOnlyDir           = 0x8
+	fanMarkMount             = 0x10
+	fanMarkIgnoredMask       = 0x20
+	fanMarkIgnoredSurvModify = 0x40
+	fanMarkFlush             = 0x80
+	fanMarkFilesystem        = 0x100
+	fanMarkInode             = 0x0
+)
+
+// Flags of newer kernels that golang.org/x/sys/unix does not define yet.
+const (
+	FAN_MARK_EVICTABLE  = 0x200  // Linux 5.19
+	FAN_MARK_IGNORE     = 0x400  // Linux 6.0
+	FAN_REPORT_FD_ERROR = 0x2000 // Linux 6.13
+)
+
+// markScopes are the mark flags selecting the object marked.
+const markScopes = fanMarkMount | fanMarkFilesystem
+
+// Layout of a FID info record: struct fanotify_event_info_fid, whose
+// f_handle is a struct file_handle, as defined by the kernel headers. All
+// fields are naturally aligned, so the offsets are the same on every
+// architecture. unsafe.Sizeof(FanotifyEventInfoFID{}) is of no use here as
+// it counts the fileHandle placeholder along with its padding.
+const (
+	fidFSIDOffset   = 4  // __kernel_fsid_t fsid, after the info header
+	fidHandleOffset = 12 // struct file_handle f_handle
+
+	handleSizeOffset = 0 // __u32 handle_bytes
+	handleTypeOffset = 4 // int handle_type
+	handleDataOffset = 8 // unsigned char f_handle[handle_bytes]
+)
+
+const (
+	// DefaultBufferSize is the size of the buffer events are read into,
+	// room for 4096 events without info records.
+	DefaultBufferSize = 4096 * int(SizeOfFanotifyEventMetadata)
+
+	// MinBufferSize fits the metadata of a single event followed by the
+	// largest set of info records the kernel reports along with it: the
+	// old and new directory entries of FAN_RENAME, each with the largest
+	// file handle (MAX_HANDLE_SZ) and name, the file handle of the object
+	// itself (FAN_REPORT_TARGET_FID), a pidfd and an error record. The
+	// kernel fails a read with EINVAL if the next event does not fit in
+	// the buffer, which stops the read loop.
+	MinBufferSize = int(SizeOfFanotifyEventMetadata) +
+		2*maxNameRecordSize + maxFIDRecordSize + pidfdRecordSize + errorRecordSize
+
+	// maxHandleSize is MAX_HANDLE_SZ, the largest file handle the kernel
+	// reports.
+	maxHandleSize = 128
+
+	// nameMax is NAME_MAX, the longest name of a directory entry.
+	nameMax = 255
+
+	// maxFIDRecordSize and maxNameRecordSize are the sizes of the largest
+	// FID info records, without and with a name, which are padded to a
+	// multiple of 4 bytes.
+	maxFIDRecordSize  = fidHandleOffset + handleDataOffset + maxHandleSize
+	maxNameRecordSize = (maxFIDRecordSize + nameMax + 1 + 3) &^ 3
+
+	// pidfdRecordSize and errorRecordSize are the sizes of struct
+	// fanotify_event_info_pidfd and struct fanotify_event_info_error.
+	pidfdRecordSize = 8
+	errorRecordSize = 12
+)
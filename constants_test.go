@@ -0,0 +1,79 @@
+//go:build linux
+// +build linux
+
+package fanotify
+
+import (
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// TestConstants checks the constants shared with the other platforms
+// against those of golang.org/x/sys/unix.
+func TestConstants(t *testing.T) {
+	for _, c := range []struct {
+		name      string
+		got, want uint64
+	}{
+		{"FAN_ACCESS", fanAccess, unix.FAN_ACCESS},
+		{"FAN_MODIFY", fanModify, unix.FAN_MODIFY},
+		{"FAN_ATTRIB", fanAttrib, unix.FAN_ATTRIB},
+		{"FAN_CLOSE_WRITE", fanCloseWrite, unix.FAN_CLOSE_WRITE},
+		{"FAN_CLOSE_NOWRITE", fanCloseNoWrite, unix.FAN_CLOSE_NOWRITE},
+		{"FAN_CLOSE", fanClose, unix.FAN_CLOSE},
+		{"FAN_OPEN", fanOpen, unix.FAN_OPEN},
+		{"FAN_MOVED_FROM", fanMovedFrom, unix.FAN_MOVED_FROM},
+		{"FAN_MOVED_TO", fanMovedTo, unix.FAN_MOVED_TO},
+		{"FAN_MOVE", fanMove, unix.FAN_MOVE},
+		{"FAN_CREATE", fanCreate, unix.FAN_CREATE},
+		{"FAN_DELETE", fanDelete, unix.FAN_DELETE},
+		{"FAN_DELETE_SELF", fanDeleteSelf, unix.FAN_DELETE_SELF},
+		{"FAN_MOVE_SELF", fanMoveSelf, unix.FAN_MOVE_SELF},
+		{"FAN_OPEN_EXEC", fanOpenExec, unix.FAN_OPEN_EXEC},
+		{"FAN_Q_OVERFLOW", fanQOverflow, unix.FAN_Q_OVERFLOW},
+		{"FAN_FS_ERROR", fanFSError, unix.FAN_FS_ERROR},
+		{"FAN_OPEN_PERM", fanOpenPerm, unix.FAN_OPEN_PERM},
+		{"FAN_ACCESS_PERM", fanAccessPerm, unix.FAN_ACCESS_PERM},
+		{"FAN_OPEN_EXEC_PERM", fanOpenExecPerm, unix.FAN_OPEN_EXEC_PERM},
+		{"FAN_EVENT_ON_CHILD", fanEventOnChild, unix.FAN_EVENT_ON_CHILD},
+		{"FAN_RENAME", fanRename, unix.FAN_RENAME},
+		{"FAN_ONDIR", fanOnDir, unix.FAN_ONDIR},
+
+		{"FAN_CLOEXEC", fanCloexec, unix.FAN_CLOEXEC},
+		{"FD_CLOEXEC", fanCloexec, unix.FD_CLOEXEC},
+		{"FAN_NONBLOCK", fanNonblock, unix.FAN_NONBLOCK},
+		{"FAN_CLASS_NOTIF", fanClassNotif, unix.FAN_CLASS_NOTIF},
+		{"FAN_CLASS_CONTENT", fanClassContent, unix.FAN_CLASS_CONTENT},
+		{"FAN_CLASS_PRE_CONTENT", fanClassPreContent, unix.FAN_CLASS_PRE_CONTENT},
+		{"FAN_ALL_CLASS_BITS", fanAllClassBits, unix.FAN_ALL_CLASS_BITS},
+		{"FAN_UNLIMITED_QUEUE", fanUnlimitedQueue, unix.FAN_UNLIMITED_QUEUE},
+		{"FAN_UNLIMITED_MARKS", fanUnlimitedMarks, unix.FAN_UNLIMITED_MARKS},
+		{"FAN_ENABLE_AUDIT", fanEnableAudit, unix.FAN_ENABLE_AUDIT},
+		{"FAN_REPORT_PIDFD", fanReportPidfd, unix.FAN_REPORT_PIDFD},
+		{"FAN_REPORT_TID", fanReportTID, unix.FAN_REPORT_TID},
+		{"FAN_REPORT_FID", fanReportFID, unix.FAN_REPORT_FID},
+		{"FAN_REPORT_DIR_FID", fanReportDirFID, unix.FAN_REPORT_DIR_FID},
+		{"FAN_REPORT_NAME", fanReportName, unix.FAN_REPORT_NAME},
+		{"FAN_REPORT_TARGET_FID", fanReportTargetFID, unix.FAN_REPORT_TARGET_FID},
+		{"FAN_REPORT_DFID_NAME", fanReportDFIDName, unix.FAN_REPORT_DFID_NAME},
+
+		{"FAN_MARK_ADD", fanMarkAdd, unix.FAN_MARK_ADD},
+		{"FAN_MARK_REMOVE", fanMarkRemove, unix.FAN_MARK_REMOVE},
+		{"FAN_MARK_DONT_FOLLOW", fanMarkDontFollow, unix.FAN_MARK_DONT_FOLLOW},
+		{"FAN_MARK_ONLYDIR", fanMarkOnlyDir, unix.FAN_MARK_ONLYDIR},
+		{"FAN_MARK_MOUNT", fanMarkMount, unix.FAN_MARK_MOUNT},
+		{"FAN_MARK_IGNORED_MASK", fanMarkIgnoredMask, unix.FAN_MARK_IGNORED_MASK},
+		{"FAN_MARK_IGNORED_SURV_MODIFY", fanMarkIgnoredSurvModify, unix.FAN_MARK_IGNORED_SURV_MODIFY},
+		{"FAN_MARK_FLUSH", fanMarkFlush, unix.FAN_MARK_FLUSH},
+		{"FAN_MARK_FILESYSTEM", fanMarkFilesystem, unix.FAN_MARK_FILESYSTEM},
+		{"FAN_MARK_INODE", fanMarkInode, unix.FAN_MARK_INODE},
+
+		{"NAME_MAX", nameMax, unix.NAME_MAX},
+		{"SizeOfFanotifyEventMetadata", uint64(SizeOfFanotifyEventMetadata), 24},
+	} {
+		if c.got != c.want {
+			t.Errorf("%s = %#x, want %#x", c.name, c.got, c.want)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+//go:build linux
+// +build linux
+
+package fanotify
+
+import (
+	"fmt"
+	"time"
+)
+
+// debouncer coalesces the events reported for the same path within a
+// window, see WatchOptions.Debounce. It is only used by the read loop.
+type debouncer struct {
+	window  time.Duration
+	pending map[debounceKey]*debounced
+	// queue holds the keys of pending in the order they are due, which
+	// is the order their first event arrived in.
+	queue []debounceKey
+}
+
+// debounceKey identifies the object of the events merged together: its
+// path, and its file handle in FAN_REPORT_FID mode, so that the events of
+// a file deleted and created again under the same path are not merged.
+type debounceKey struct {
+	path   string
+	handle string // filesystem id, handle type and handle, if any
+}
+
+// debounceKeyOf returns the key ev is merged under.
+func debounceKeyOf(ev Event) debounceKey {
+	key := debounceKey{path: ev.Path}
+	if ev.Handle != nil {
+		key.handle = fmt.Sprintf("%x:%d:%x", ev.FSID.Val, ev.Handle.Type(), ev.Handle.Bytes())
+	}
+	return key
+}
+
+// debounced is an event collecting the masks of the events it absorbed.
+type debounced struct {
+	ev  Event
+	due time.Time
+}
+
+func newDebouncer(window time.Duration) *debouncer {
+	return &debouncer{window: window, pending: make(map[debounceKey]*debounced)}
+}
+
+// debounceable reports whether ev may be held back and merged. Events that
+// need a response, overflows and renames, which describe two paths, are
+// delivered right away.
+func debounceable(ev Event) bool {
+	return !ev.ResponseRequired && !ev.Overflow && ev.Rename == nil && ev.Path != ""
+}
+
+// add holds back ev, merging it into the event pending for its object if
+// there is one. The merged event keeps the descriptors, the time and the
+// sequence number of the first event, those of ev are released.
+func (d *debouncer) add(ev Event) {
+	key := debounceKeyOf(ev)
+	p, ok := d.pending[key]
+	if !ok {
+		d.pending[key] = &debounced{ev: ev, due: ev.Time.Add(d.window)}
+		d.queue = append(d.queue, key)
+		return
+	}
+	p.ev.Mask |= ev.Mask
+	p.ev.Values = MaskValues(p.ev.Mask)
+	p.ev.IsDir = p.ev.IsDir || ev.IsDir
+	p.ev.FromSelf = p.ev.FromSelf && ev.FromSelf
+	ev.Close()
+}
+
+// next returns when the first pending event is due, if there is one.
+func (d *debouncer) next() (time.Time, bool) {
+	if d == nil || len(d.queue) == 0 {
+		return time.Time{}, false
+	}
+	return d.pending[d.queue[0]].due, true
+}
+
+// due removes and returns the pending events due at now.
+func (d *debouncer) due(now time.Time) []Event {
+	var events []Event
+	for len(d.queue) > 0 {
+		p := d.pending[d.queue[0]]
+		if p.due.After(now) {
+			break
+		}
+		events = append(events, p.ev)
+		delete(d.pending, d.queue[0])
+		d.queue = d.queue[1:]
+	}
+	return events
+}
+
+// drop releases the pending events once the read loop stops.
+func (d *debouncer) drop() {
+	if d == nil {
+		return
+	}
+	for key, p := range d.pending {
+		p.ev.Close()
+		delete(d.pending, key)
+	}
+	d.queue = nil
+}
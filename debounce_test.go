@@ -0,0 +1,147 @@
+//go:build linux
+// +build linux
+
+package fanotify
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// nullFd returns a descriptor to be owned by an event.
+func nullFd(t testing.TB) int32 {
+	t.Helper()
+	fd, err := unix.Open("/dev/null", unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return int32(fd)
+}
+
+// isOpen reports whether fd is an open descriptor.
+func isOpen(fd int32) bool {
+	_, err := unix.FcntlInt(uintptr(fd), unix.F_GETFD, 0)
+	return err == nil
+}
+
+// TestDebounce drives a debouncer with the times of the events rather than
+// the clock: events for the same path within the window are merged into
+// the first, in the order the first of each path arrived.
+func TestDebounce(t *testing.T) {
+	const window = 100 * time.Millisecond
+	start := time.Unix(1000, 0)
+	d := newDebouncer(window)
+	fds := []int32{nullFd(t), nullFd(t), nullFd(t)}
+	d.add(Event{Seq: 1, Time: start, Path: "/a", Mask: unix.FAN_MODIFY, Fd: fds[0], PidFd: unix.FAN_NOPIDFD})
+	d.add(Event{Seq: 2, Time: start.Add(5 * time.Millisecond), Path: "/b", Mask: unix.FAN_MODIFY, Fd: fds[1], PidFd: unix.FAN_NOPIDFD})
+	d.add(Event{Seq: 3, Time: start.Add(10 * time.Millisecond), Path: "/a", Mask: unix.FAN_CLOSE_WRITE, Fd: fds[2], PidFd: unix.FAN_NOPIDFD})
+	if isOpen(fds[2]) {
+		t.Error("descriptor of the merged event not released")
+	}
+
+	if due, ok := d.next(); !ok || !due.Equal(start.Add(window)) {
+		t.Errorf("next %v %v, want %v", due, ok, start.Add(window))
+	}
+	if events := d.due(start.Add(window - time.Nanosecond)); len(events) != 0 {
+		t.Errorf("%d events due before the window passed", len(events))
+	}
+	events := d.due(start.Add(window))
+	if len(events) != 1 {
+		t.Fatalf("got %d events, want 1", len(events))
+	}
+	a := events[0]
+	if a.Path != "/a" || a.Mask != unix.FAN_MODIFY|unix.FAN_CLOSE_WRITE || a.Seq != 1 || !a.Time.Equal(start) || a.Fd != fds[0] {
+		t.Errorf("merged event %+v", a)
+	}
+	if len(a.Values) != 2 {
+		t.Errorf("merged values %v", a.Values)
+	}
+	a.Close()
+
+	if due, ok := d.next(); !ok || !due.Equal(start.Add(5*time.Millisecond+window)) {
+		t.Errorf("next %v %v", due, ok)
+	}
+	events = d.due(start.Add(time.Second))
+	if len(events) != 1 || events[0].Path != "/b" || events[0].Seq != 2 {
+		t.Fatalf("got %+v, want /b", events)
+	}
+	events[0].Close()
+	if _, ok := d.next(); ok {
+		t.Error("events left pending")
+	}
+}
+
+// TestDebounceHandles checks that the events of a path are kept apart when
+// their file handles differ, as for a file deleted and created again.
+func TestDebounceHandles(t *testing.T) {
+	start := time.Unix(1000, 0)
+	d := newDebouncer(time.Second)
+	deleted := unix.NewFileHandle(1, []byte{1, 2, 3, 4})
+	created := unix.NewFileHandle(1, []byte{5, 6, 7, 8})
+	for i, c := range []struct {
+		mask   uint64
+		handle unix.FileHandle
+	}{
+		{unix.FAN_MODIFY, deleted},
+		{unix.FAN_DELETE_SELF, deleted},
+		{unix.FAN_MODIFY, created},
+	} {
+		d.add(Event{Seq: uint64(i + 1), Time: start, Path: "/a", Mask: c.mask, Handle: &c.handle,
+			Fd: unix.FAN_NOFD, PidFd: unix.FAN_NOPIDFD})
+	}
+	events := d.due(start.Add(time.Second))
+	if len(events) != 2 {
+		t.Fatalf("got %d events, want 2", len(events))
+	}
+	if events[0].Mask != unix.FAN_MODIFY|unix.FAN_DELETE_SELF || events[0].Seq != 1 {
+		t.Errorf("deleted file: %+v", events[0])
+	}
+	if events[1].Mask != unix.FAN_MODIFY || events[1].Seq != 3 {
+		t.Errorf("created file: %+v", events[1])
+	}
+}
+
+// TestFakeDebounce delivers a merged event once the window has passed,
+// and releases the events still pending when the watcher is closed.
+func TestFakeDebounce(t *testing.T) {
+	w, f := newFakeWatcher(t, t.TempDir(), WatchOptions{
+		Mask:     unix.FAN_OPEN | unix.FAN_CLOSE_WRITE,
+		Debounce: 200 * time.Millisecond,
+	})
+	fd, path := openFd(t, "a")
+	dup, err := unix.Dup(int(fd))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.feed(t, append(rawEvent(unix.FAN_OPEN, fd, 42), rawEvent(unix.FAN_CLOSE_WRITE, int32(dup), 42)...))
+	ev := receive(t, w)
+	if ev.Path != path || ev.Mask != unix.FAN_OPEN|unix.FAN_CLOSE_WRITE || ev.Seq != 1 {
+		t.Errorf("got %v %v seq %d, want %v merged", ev.Path, ev.Values, ev.Seq, path)
+	}
+	ev.Close()
+
+	fd, _ = openFd(t, "b")
+	f.feed(t, rawEvent(unix.FAN_OPEN, fd, 42))
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		f.mu.Lock()
+		read := len(f.reads) == 0
+		f.mu.Unlock()
+		if read {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("event not read")
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if isOpen(fd) {
+		t.Error("descriptor of the pending event not released")
+	}
+	for ev := range w.Events() {
+		t.Errorf("event %v delivered after Close", ev.Path)
+	}
+}
@@ -0,0 +1,78 @@
+// Package fanotify watches directories, or the mounts or filesystems they
+// belong to, with fanotify(7) and delivers the events reported for them on
+// a channel. fanotify requires CAP_SYS_ADMIN, watchers cannot be created
+// without it. The fanotify command in cmd/fanotify prints the events of a
+// directory.
+//
+// Each preset returns the fanotify_init(2) flags and the event mask for a
+// common case, to be passed to NewWatcher or as WatchOptions.Flags and
+// Mask. The events of a watcher are consumed from its Events channel until
+// it is closed, after which Err tells why the read loop stopped:
+//
+//	flags, mask := fanotify.FileAccessedOrModified()
+//	w, err := fanotify.NewWatcherWithOptions("/srv/data", fanotify.WatchOptions{Flags: flags, Mask: mask})
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	defer w.Close()
+//	for ev := range w.Events() {
+//		fmt.Println(ev) // e.g. "MODIFY /srv/data/log (pid 1234)"
+//		ev.Close()
+//	}
+//	if err := w.Err(); err != nil {
+//		log.Fatal(err)
+//	}
+//
+// The events of FileAccessedOrModified, FileCloseWriteNoWrite,
+// FileAttribChange and FileOpenExec are reported for the children of the
+// marked directory. FileOpenExec is typically used on a whole mount, which
+// covers files at any depth:
+//
+//	flags, mask := fanotify.FileOpenExec()
+//	w, err := fanotify.NewWatcherWithOptions("/", fanotify.WatchOptions{
+//		Flags:     flags,
+//		Mask:      mask,
+//		MarkFlags: unix.FAN_MARK_MOUNT,
+//	})
+//
+// FileOrDirCreated reports the directory an entry was created in, while
+// FileOrDirEntryChanged and FileRenamed report the entry itself in
+// Event.Name, joined to the directory in Event.Path. A FileRenamed event
+// carries both entries:
+//
+//	flags, mask := fanotify.FileRenamed()
+//	w, err := fanotify.NewWatcher("/srv/data", flags, fanotify.DefaultFileStatusFlags, unix.FAN_MARK_ADD, mask, 0)
+//	...
+//	for ev := range w.Events() {
+//		if r := ev.Rename; r != nil {
+//			fmt.Println(r.OldName, "->", filepath.Join(r.NewDir, r.NewName))
+//		}
+//	}
+//
+// FileDeleteSelf reports the deletion of the marked directory itself, for
+// which Event.MarkRemoved is set:
+//
+//	for ev := range w.Events() {
+//		if ev.MarkRemoved {
+//			log.Printf("%s was deleted", ev.MarkPath)
+//		}
+//	}
+//
+// FilePermission, FilePreContent and FileExecPermission report permission
+// events, which block the accessing process until they are answered. Every
+// one of them must be passed to Respond, which also releases the event
+// descriptor:
+//
+//	flags, mask := fanotify.FilePermission()
+//	w, err := fanotify.NewWatcherWithOptions("/srv/data", fanotify.WatchOptions{Flags: flags, Mask: mask})
+//	...
+//	for ev := range w.Events() {
+//		allow := !strings.HasSuffix(ev.Path, ".secret")
+//		if err := w.Respond(ev.Fd, allow); err != nil {
+//			log.Print(err)
+//		}
+//		ev.Close()
+//	}
+//
+// Whether a preset works depends on the kernel version, see Supported.
+package fanotify
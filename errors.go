@@ -0,0 +1,135 @@
+package fanotify
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrInvalidData = errors.New("i/o error: unexpected data length")
+	ErrClosed      = errors.New("fanotify: watcher closed")
+	// ErrBufferTooSmall is returned for read buffers smaller than
+	// MinBufferSize.
+	ErrBufferTooSmall = errors.New("fanotify: buffer too small to hold an event")
+	// ErrIncompatibleVersion is matched by the *MetadataVersionError
+	// returned when the kernel reports events with a metadata version
+	// other than FANOTIFY_METADATA_VERSION.
+	ErrIncompatibleVersion = errors.New("fanotify: incompatible metadata version")
+	// ErrInodeEventsOnMount is returned when directory entry, attrib or
+	// self events are requested on a mount mark.
+	ErrInodeEventsOnMount = errors.New("fanotify: inode events are not supported on mount marks")
+	// ErrInvalidOptions is returned by NewWatcherWithOptions for options
+	// that conflict with each other.
+	ErrInvalidOptions = errors.New("fanotify: invalid options")
+	// ErrUnknownEvent is returned by MaskFromStrings for names that do not
+	// match any event.
+	ErrUnknownEvent = errors.New("fanotify: unknown event")
+	// ErrResponseTimeout is returned by Respond for permission events that
+	// were answered by WatchOptions.ResponseTimeout already.
+	ErrResponseTimeout = errors.New("fanotify: permission event timed out")
+	// ErrReinitialized is returned by Respond for permission events that
+	// Reinit allowed before replacing the descriptor they were read from.
+	ErrReinitialized = errors.New("fanotify: permission event answered by Reinit")
+	// ErrUnsupportedPlatform is returned on systems other than Linux,
+	// which lack fanotify, by the constructors of Watcher.
+	ErrUnsupportedPlatform = errors.New("fanotify: not supported on this platform")
+	// ErrProcUnavailable is returned when /proc is not mounted or not
+	// accessible, through which the paths of events are resolved.
+	ErrProcUnavailable = errors.New("fanotify: /proc is not available")
+	// ErrMountNotFound is returned when no mount in /proc/self/mountinfo
+	// belongs to the filesystem of a marked path or event, so that its
+	// file handles cannot be opened. This happens in mount namespaces
+	// whose mount table lacks the filesystem.
+	ErrMountNotFound = errors.New("fanotify: no mount found")
+	// ErrNoFd is returned by Respond for FAN_NOFD, and reported for
+	// permission events the kernel delivered without a descriptor, which
+	// cannot be answered.
+	ErrNoFd = errors.New("fanotify: permission event without descriptor")
+	// ErrPidfdUnavailable is reported in Event.PidFdError when the kernel
+	// failed to create a pidfd for a reason other than the process having
+	// exited.
+	ErrPidfdUnavailable = errors.New("fanotify: pidfd could not be created")
+
+	// The following errors are matched with errors.Is by the errors of the
+	// methods adding and removing marks, after the errno the kernel failed
+	// them with, which the errors keep wrapping. ErrPermission is matched
+	// by the errors of the constructors of Watcher too.
+
+	// ErrPathNotFound is matched for ENOENT: the path to mark does not
+	// exist, yet, and marking it may be retried once it appears. Removing
+	// a mark fails with it as well if the path carries no such mark.
+	ErrPathNotFound = errors.New("fanotify: path not found")
+	// ErrNotDirectory is matched for ENOTDIR: a component of the path is
+	// not a directory, or FAN_MARK_ONLYDIR was given for a non-directory.
+	ErrNotDirectory = errors.New("fanotify: not a directory")
+	// ErrPermission is matched for EPERM and EACCES: the process lacks
+	// CAP_SYS_ADMIN, which fanotify_init requires for most flags and mount
+	// and filesystem marks require, or may not read the path.
+	ErrPermission = errors.New("fanotify: permission denied")
+	// ErrMarkLimit is matched for ENOSPC: the user has as many marks as
+	// allowed, see /proc/sys/fs/fanotify/max_user_marks (Linux 5.13),
+	// unless the watcher was created with FAN_UNLIMITED_MARKS.
+	ErrMarkLimit = errors.New("fanotify: too many marks")
+)
+
+// namedError is an error that matches a named error besides the errors it
+// wraps, keeping their message.
+type namedError struct {
+	err   error
+	named error
+}
+
+func (e *namedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *namedError) Unwrap() []error {
+	return []error{e.err, e.named}
+}
+
+// SyscallError records a failed system call along with the path it
+// operated on, so that callers watching many paths can tell failures
+// apart. The underlying errno is available through errors.Is and
+// errors.As.
+type SyscallError struct {
+	Op   string // system call, e.g. "FanotifyMark"
+	Path string // path the call operated on, empty if none
+	Err  error  // error returned by the call
+}
+
+func (e *SyscallError) Error() string {
+	if e.Path == "" {
+		return e.Op + ": " + e.Err.Error()
+	}
+	return e.Op + " " + e.Path + ": " + e.Err.Error()
+}
+
+func (e *SyscallError) Unwrap() error {
+	return e.Err
+}
+
+// newSyscallError returns a *SyscallError for op on path, or nil if err is
+// nil.
+func newSyscallError(op, path string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &SyscallError{Op: op, Path: path, Err: err}
+}
+
+// MetadataVersionError is returned by the read loop when the kernel reports
+// events with a metadata version other than the FANOTIFY_METADATA_VERSION
+// the program was built with, which calls for a rebuild against a matching
+// golang.org/x/sys. It matches ErrIncompatibleVersion with errors.Is.
+type MetadataVersionError struct {
+	Kernel   uint8 // version reported by the kernel
+	Compiled uint8 // FANOTIFY_METADATA_VERSION
+}
+
+func (e *MetadataVersionError) Error() string {
+	return fmt.Sprintf("%v: kernel reports version %d, built for version %d", ErrIncompatibleVersion, e.Kernel, e.Compiled)
+}
+
+func (e *MetadataVersionError) Unwrap() error {
+	return ErrIncompatibleVersion
+}
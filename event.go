@@ -0,0 +1,258 @@
+//go:build linux
+// +build linux
+
+package fanotify
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Event is a decoded fanotify event.
+type Event struct {
+	// Path is the resolved path of the object the event refers to. It is
+	// empty for a FAN_REPORT_DFID_NAME event that could not be resolved as
+	// /proc is no longer available, which is delivered with Name only.
+	Path string
+	// Name is the directory entry name carried by
+	// FAN_EVENT_INFO_TYPE_DFID_NAME records, in which case Path is the
+	// parent directory joined with Name. It is empty otherwise.
+	Name string
+	// Handle and FSID identify the object in FAN_REPORT_FID mode, the
+	// parent directory for DFID_NAME records. They allow deferred
+	// resolution with OpenByHandleAt on a descriptor of a mount of the
+	// filesystem whose statfs f_fsid equals FSID. Handle is nil otherwise.
+	Handle *unix.FileHandle
+	FSID   unix.Fsid
+	// MountPoint and Dev describe the mount the path of a FAN_REPORT_FID
+	// event was resolved through, Dev being the device number of its
+	// filesystem, split by unix.Major and unix.Minor. The kernel reports
+	// the filesystem of the object but not the mount it was accessed
+	// through: of the mounts of a filesystem, e.g. bind mounts, a mount
+	// of its root is used, and Path lies below MountPoint. Both are empty
+	// in other modes.
+	MountPoint string
+	Dev        uint64
+	// HandleFile is the object identified by Handle, opened read-only
+	// while resolving the event if WatchOptions.OpenHandles is set, so it
+	// can be read without racing against a rename. For events carrying a
+	// Name it is therefore the parent directory, not the named entry. It
+	// is nil otherwise, for objects other than regular files and
+	// directories, such as FIFOs and devices, and for objects that could
+	// not be opened for reading. The file is owned by the receiver of the
+	// event and closed by Close; a leaked file is closed when it is
+	// garbage collected.
+	HandleFile *os.File
+	// IsDir is set if the object is a directory. The kernel reports
+	// FAN_ONDIR for such events, which are only generated for
+	// directories if the mask includes FAN_ONDIR. For directory entry
+	// events it describes the entry rather than its parent directory, and
+	// is known even when the entry is already gone.
+	IsDir bool
+	// Rename holds both directory entries of a FAN_RENAME event, for
+	// which Path and Name refer to the new entry. It is nil otherwise.
+	Rename *RenameEvent
+	// MarkPath is the path the inode mark was added with for
+	// FAN_DELETE_SELF and FAN_MOVE_SELF events, so the caller can tell
+	// which mark went stale and re-establish it. Path falls back to it if
+	// the object can no longer be resolved. MarkRemoved is set after
+	// FAN_DELETE_SELF, for which the kernel drops the mark along with the
+	// inode; a moved inode keeps its mark at the new path.
+	MarkPath    string
+	MarkRemoved bool
+	// Time is when the event was read from the fanotify descriptor. The
+	// kernel does not timestamp events, so this is the userspace read time,
+	// which lags behind the access when events queue up.
+	Time time.Time
+	// Seq numbers the events read by a watcher in the order the kernel
+	// reported them, starting at 1. Events rejected by the filter or
+	// dropped as they could not be resolved still use up a number, so a
+	// gap between two delivered events tells how many were not delivered
+	// in between; events the kernel dropped are not numbered but reported
+	// by an Overflow event. A debounced event carries the number of the
+	// first event it combines.
+	Seq uint64
+	// Mask is the raw event mask reported by the kernel.
+	Mask uint64
+	// Pid is the id of the process that caused the event. If the watcher
+	// was initialized with FAN_REPORT_TID it is the id of the thread
+	// instead, see Watcher.ReportsTID.
+	Pid int32
+	// FromSelf is set for events caused by the watching process itself,
+	// e.g. when it opens files reported by a mount or filesystem mark.
+	// Acting on such events can feed back into further events. Reads
+	// through the event descriptor, see File, never cause events.
+	FromSelf bool
+	// Comm and Cmdline are the name and command line of the process
+	// identified by Pid, empty until looked up by Process.
+	Comm    string
+	Cmdline string
+	// PidFd is a pidfd referring to the process that caused the event,
+	// reported with FAN_REPORT_PIDFD. Unlike Pid it cannot be recycled
+	// while it is held open. It is FAN_NOPIDFD when the event carries
+	// none. The descriptor is owned by the receiver of the event and
+	// released by Close.
+	PidFd int32
+	// PidFdError tells why the kernel reported no pidfd in place of one:
+	// unix.ESRCH if the process had already exited (FAN_NOPIDFD), and
+	// ErrPidfdUnavailable for any other failure (FAN_EPIDFD). It is nil
+	// if PidFd is valid or was not requested.
+	PidFdError error
+	// Values holds the names of the bits set in Mask, see MaskValues. The
+	// events read by a watcher share the slice with the other events of
+	// the same mask, so it must not be modified.
+	Values []string
+	// Overflow is set for FAN_Q_OVERFLOW events, reported in place of the
+	// events the kernel dropped because its queue was full. Such events
+	// carry no path. Initializing with FAN_UNLIMITED_QUEUE lifts the limit
+	// of 16384 queued events.
+	Overflow bool
+	// Fd is the event file descriptor as reported by the kernel, open on
+	// the object with the file status flags given to NewWatcher, or
+	// FAN_NOFD in FAN_REPORT_FID mode. It may be used to read the file
+	// directly. The descriptor is owned by the receiver of the event: it
+	// is released by Close, or by Respond for permission events.
+	Fd int32
+	// FdError is the error the kernel failed to open the object of the
+	// event with, reported with FAN_REPORT_FD_ERROR in place of Fd, which
+	// is then FAN_NOFD. Path is empty for such events. Without the flag
+	// the kernel drops them instead.
+	FdError error
+	// FSError is the first error a filesystem reported since the last
+	// FAN_FS_ERROR event, and FSErrorCount the number of errors since
+	// then, as carried by FAN_EVENT_INFO_TYPE_ERROR records (Linux 5.16).
+	// Errors of the filesystem as a whole come without an object, leaving
+	// Path empty. FSError is nil for other events.
+	FSError      error
+	FSErrorCount uint32
+	// ResponseRequired is set for permission events. Such events must be
+	// answered with Watcher.Respond passing Fd. It is not set for those
+	// the kernel delivered without a descriptor, which cannot be answered
+	// and are reported on Watcher.Errors wrapping ErrNoFd.
+	ResponseRequired bool
+
+	// records are the file identifier records of the event, from which
+	// the watcher resolves paths.
+	records []fidRecord
+}
+
+// RenameEvent describes a rename reported by FAN_RENAME with the
+// FAN_EVENT_INFO_TYPE_OLD_DFID_NAME and NEW_DFID_NAME records. A directory
+// is empty if it could no longer be resolved when the event was read.
+type RenameEvent struct {
+	OldDir  string
+	OldName string
+	NewDir  string
+	NewName string
+}
+
+// permissionEvents are the mask bits for which the kernel waits on a
+// response before letting the access proceed.
+const permissionEvents = unix.FAN_OPEN_PERM | unix.FAN_ACCESS_PERM | unix.FAN_OPEN_EXEC_PERM
+
+func newEvent(metadata *unix.FanotifyEventMetadata, pidfd int32, path string) Event {
+	return Event{
+		Path:  path,
+		Mask:  metadata.Mask,
+		Pid:   metadata.Pid,
+		Fd:    metadata.Fd,
+		PidFd: pidfd,
+		IsDir: metadata.Mask&unix.FAN_ONDIR != 0,
+
+		// a response is written for the descriptor, there is none to
+		// answer with FAN_NOFD or FAN_REPORT_FD_ERROR
+		ResponseRequired: metadata.Mask&permissionEvents != 0 && metadata.Fd >= 0,
+	}
+}
+
+// File returns a file reading the object of the event through a duplicate of
+// Fd, e.g. to scan the contents before answering a permission event. The
+// file is independent of the event and must be closed by the caller; as the
+// duplicate shares the file offset with Fd, reads advance both.
+//
+// Accesses through the event descriptor do not generate fanotify events,
+// the kernel opens it without notification. Opening Path again instead
+// does, and for a permission event on the same file it blocks until the
+// watcher answers it, which the read loop cannot do while waiting on the
+// caller.
+func (ev *Event) File() (*os.File, error) {
+	if ev.Fd < 0 {
+		return nil, fmt.Errorf("event without file descriptor: %w", unix.EBADF)
+	}
+	fd, err := unix.FcntlInt(uintptr(ev.Fd), unix.F_DUPFD_CLOEXEC, 0)
+	if err != nil {
+		return nil, newSyscallError("FcntlInt", ev.Path, err)
+	}
+	return os.NewFile(uintptr(fd), ev.Path), nil
+}
+
+// Close releases the descriptors owned by the event. It should be called
+// once the event has been consumed. Fd of a permission event is left to
+// Respond, which must be called first.
+func (ev *Event) Close() error {
+	err := closePidfd(ev.PidFd)
+	ev.PidFd = unix.FAN_NOPIDFD
+	if ev.HandleFile != nil {
+		if cerr := ev.HandleFile.Close(); err == nil {
+			err = cerr
+		}
+		ev.HandleFile = nil
+	}
+	if ev.Fd >= 0 && !ev.ResponseRequired {
+		if cerr := unix.Close(int(ev.Fd)); err == nil {
+			err = cerr
+		}
+		ev.Fd = unix.FAN_NOFD
+	}
+	return err
+}
+
+// closePidfd closes pidfd unless it is one of the negative values the
+// kernel reports in place of a descriptor.
+func closePidfd(pidfd int32) error {
+	if pidfd < 0 {
+		return nil
+	}
+	return unix.Close(int(pidfd))
+}
+
+// Process returns the name and command line of the process identified by
+// Pid, read from /proc on the first call and kept in Comm and Cmdline. The
+// lookup is left to the receiver of the event, as it takes two reads of
+// /proc that most consumers do not need. It should be done promptly: a pid
+// may be reused once its process exits. If the process already exited the
+// pid is returned as name along with a nil error.
+func (ev *Event) Process() (comm, cmdline string, err error) {
+	if ev.Comm == "" {
+		ev.Comm, ev.Cmdline, err = resolvePid(ev.Pid)
+	}
+	return ev.Comm, ev.Cmdline, err
+}
+
+// resolvePid reads the name and command line of the process pid from
+// /proc. The process may have exited by the time the event is read, in
+// which case the numeric pid is returned as name along with a nil error.
+func resolvePid(pid int32) (name, cmdline string, err error) {
+	dir := "/proc/" + strconv.Itoa(int(pid))
+	comm, err := os.ReadFile(dir + "/comm")
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return strconv.Itoa(int(pid)), "", nil
+		}
+		return "", "", err
+	}
+	args, err := os.ReadFile(dir + "/cmdline")
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", "", err
+	}
+	args = bytes.TrimRight(args, "\x00")
+	args = bytes.ReplaceAll(args, []byte{0}, []byte{' '})
+	return strings.TrimSuffix(string(comm), "\n"), string(args), nil
+}
@@ -0,0 +1,90 @@
+package fanotify
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Has reports whether every bit of mask is set in the event mask, e.g.
+// ev.Has(fanCreate | fanOnDir) for a created directory. Unlike
+// comparing the names in Values it does not allocate.
+func (ev Event) Has(mask uint64) bool {
+	return ev.Mask&mask == mask
+}
+
+// IsAccess reports whether the event includes FAN_ACCESS.
+func (ev Event) IsAccess() bool { return ev.Mask&fanAccess != 0 }
+
+// IsModify reports whether the event includes FAN_MODIFY.
+func (ev Event) IsModify() bool { return ev.Mask&fanModify != 0 }
+
+// IsAttrib reports whether the event includes FAN_ATTRIB.
+func (ev Event) IsAttrib() bool { return ev.Mask&fanAttrib != 0 }
+
+// IsCloseWrite reports whether the event includes FAN_CLOSE_WRITE.
+func (ev Event) IsCloseWrite() bool { return ev.Mask&fanCloseWrite != 0 }
+
+// IsCloseNoWrite reports whether the event includes FAN_CLOSE_NOWRITE.
+func (ev Event) IsCloseNoWrite() bool { return ev.Mask&fanCloseNoWrite != 0 }
+
+// IsOpen reports whether the event includes FAN_OPEN.
+func (ev Event) IsOpen() bool { return ev.Mask&fanOpen != 0 }
+
+// IsOpenExec reports whether the event includes FAN_OPEN_EXEC.
+func (ev Event) IsOpenExec() bool { return ev.Mask&fanOpenExec != 0 }
+
+// IsCreate reports whether the event includes FAN_CREATE.
+func (ev Event) IsCreate() bool { return ev.Mask&fanCreate != 0 }
+
+// IsDelete reports whether the event includes FAN_DELETE.
+func (ev Event) IsDelete() bool { return ev.Mask&fanDelete != 0 }
+
+// IsMovedFrom reports whether the event includes FAN_MOVED_FROM.
+func (ev Event) IsMovedFrom() bool { return ev.Mask&fanMovedFrom != 0 }
+
+// IsMovedTo reports whether the event includes FAN_MOVED_TO.
+func (ev Event) IsMovedTo() bool { return ev.Mask&fanMovedTo != 0 }
+
+// IsDeleteSelf reports whether the event includes FAN_DELETE_SELF.
+func (ev Event) IsDeleteSelf() bool { return ev.Mask&fanDeleteSelf != 0 }
+
+// IsMoveSelf reports whether the event includes FAN_MOVE_SELF.
+func (ev Event) IsMoveSelf() bool { return ev.Mask&fanMoveSelf != 0 }
+
+// IsRename reports whether the event includes FAN_RENAME.
+func (ev Event) IsRename() bool { return ev.Mask&fanRename != 0 }
+
+// String formats the event on a single line, e.g.
+// "MODIFY,CLOSE_WRITE /path/to/file (pid 1234 comm=vim)", the name of the
+// process being included once looked up by Process. The names of the mask
+// bits are listed in ascending bit order.
+func (ev Event) String() string {
+	var names []string
+	for bit := uint64(1); bit != 0; bit <<= 1 {
+		if ev.Mask&bit == 0 {
+			continue
+		}
+		v, ok := maskTable[int(bit)]
+		if !ok {
+			names = append(names, fmt.Sprintf("%#x", bit))
+			continue
+		}
+		names = append(names, strings.ToUpper(strings.ReplaceAll(v.value, "-", "_")))
+	}
+	var b strings.Builder
+	b.WriteString(strings.Join(names, ","))
+	switch {
+	case ev.Rename != nil:
+		r := ev.Rename
+		b.WriteString(" " + filepath.Join(r.OldDir, r.OldName) + " -> " + filepath.Join(r.NewDir, r.NewName))
+	case ev.Path != "":
+		b.WriteString(" " + ev.Path)
+	}
+	fmt.Fprintf(&b, " (pid %d", ev.Pid)
+	if ev.Comm != "" {
+		b.WriteString(" comm=" + ev.Comm)
+	}
+	b.WriteString(")")
+	return b.String()
+}
@@ -0,0 +1,116 @@
+//go:build linux
+// +build linux
+
+package fanotify_test
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+
+	"github.com/r00tu53r/fanotify"
+)
+
+// The examples need CAP_SYS_ADMIN and watch a directory of the system, so
+// they are compiled but not run.
+
+func ExampleFileAccessedOrModified() {
+	flags, mask := fanotify.FileAccessedOrModified()
+	w, err := fanotify.NewWatcherWithOptions("/var/log", fanotify.WatchOptions{Flags: flags, Mask: mask})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer w.Close()
+
+	// the path of each event is that of the descriptor the kernel opened,
+	// which must be closed once the event is handled
+	for ev := range w.Events() {
+		fmt.Println(ev.Values, ev.Path, ev.Pid)
+		ev.Close()
+	}
+	if err := w.Err(); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func ExampleFileOrDirEntryChanged() {
+	flags, mask := fanotify.FileOrDirEntryChanged()
+	w, err := fanotify.NewWatcherWithOptions("/srv/uploads", fanotify.WatchOptions{Flags: flags, Mask: mask})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer w.Close()
+
+	// entry events name the entry within the watched directory, which
+	// may be gone by the time the event is read
+	for ev := range w.Events() {
+		switch {
+		case ev.IsDir:
+			fmt.Println(ev.Values, "directory", ev.Name)
+		default:
+			fmt.Println(ev.Values, ev.Name)
+		}
+		ev.Close()
+	}
+}
+
+func ExampleFileRenamed() {
+	flags, mask := fanotify.FileRenamed()
+	w, err := fanotify.NewWatcherWithOptions("/srv/uploads", fanotify.WatchOptions{Flags: flags, Mask: mask})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer w.Close()
+
+	var from string
+	for ev := range w.Events() {
+		ev.Close()
+		switch {
+		case ev.Rename != nil:
+			fmt.Println(ev.Rename.OldName, "->", ev.Rename.NewName)
+		case ev.IsMovedFrom():
+			// before Linux 5.17, as two events
+			from = ev.Name
+		default:
+			fmt.Println(from, "->", ev.Name)
+		}
+	}
+}
+
+func ExampleFileDeleteSelf() {
+	flags, mask := fanotify.FileDeleteSelf()
+	w, err := fanotify.NewWatcherWithOptions("/srv/uploads", fanotify.WatchOptions{Flags: flags, Mask: mask})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer w.Close()
+
+	for ev := range w.Events() {
+		ev.Close()
+		if ev.MarkRemoved {
+			// the watched directory is gone along with its mark
+			fmt.Println(ev.MarkPath, "removed")
+			return
+		}
+		fmt.Println(ev.Values, ev.Path)
+	}
+}
+
+func ExampleFilePermission() {
+	flags, mask := fanotify.FilePermission()
+	w, err := fanotify.NewWatcherWithOptions("/etc/secrets", fanotify.WatchOptions{Flags: flags, Mask: mask})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer w.Close()
+
+	// the process opening a file stays blocked until the event is
+	// answered, so every permission event gets a response
+	for ev := range w.Events() {
+		allow := filepath.Ext(ev.Path) != ".key"
+		if err := w.Respond(ev.Fd, allow); err != nil {
+			log.Print(err)
+		}
+		ev.Close()
+	}
+}
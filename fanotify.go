@@ -1,20 +1,18 @@
 //go:build linux
 // +build linux
 
-package main
+package fanotify
 
 import (
-	"bufio"
 	"bytes"
-	"encoding/binary"
 	"errors"
-	"flag"
 	"fmt"
 	"io"
-	"log"
 	"os"
+	"path/filepath"
 	"strconv"
-	"strings"
+	"sync/atomic"
+	"time"
 	"unsafe"
 
 	"golang.org/x/sys/unix"
@@ -44,354 +42,645 @@ type FanotifyEventInfoFID struct {
 	fileHandle byte
 }
 
-var (
-	watchDir            string
-	ErrInvalidData      = errors.New("i/o error: unexpected data length")
-	initFlags           uint
-	initFileStatusFlags uint
-	markFlags           uint
-	markMaskFlags       uint64
-)
+// Pidfd info record.
+// This structure is used for records of type FAN_EVENT_INFO_TYPE_PIDFD,
+// reported when fanotify is initialized with FAN_REPORT_PIDFD.
+type FanotifyEventInfoPidfd struct {
+	Header FanotifyEventInfoHeader
+	Pidfd  int32
+}
+
+// Error info record.
+// This structure is used for records of type FAN_EVENT_INFO_TYPE_ERROR,
+// reported along with FAN_FS_ERROR events (Linux 5.16).
+type FanotifyEventInfoError struct {
+	Header     FanotifyEventInfoHeader
+	Error      int32
+	ErrorCount uint32
+}
 
 const (
 	SizeOfFanotifyEventMetadata = uint32(unsafe.Sizeof(unix.FanotifyEventMetadata{}))
-)
-
-func init() {
-	flag.StringVar(&watchDir, "watchdir", "", "path to directory to be watched")
-}
 
-func usage() {
-	fmt.Printf("%s -watchdir /directory/to/monitor\n", os.Args[0])
-}
+	// DefaultFileStatusFlags are the file status flags of the file
+	// descriptors opened for events, suitable for NewWatcher.
+	DefaultFileStatusFlags = unix.O_RDONLY | unix.O_CLOEXEC | unix.O_LARGEFILE
 
-func main() {
-	flag.Parse()
-	if watchDir == "" {
-		usage()
-		os.Exit(1)
-	}
-	watch(watchDir)
-}
+	// reportFIDFlags are the init flags under which events carry file
+	// handles in info records instead of open file descriptors.
+	reportFIDFlags = unix.FAN_REPORT_FID | unix.FAN_REPORT_DIR_FID
 
-// fileAccessedOrModified raises event when
-// (1) "file" is created or modified under the monitored directory.
-// The metadata.Fd is the file descriptor to the file created/modified.
-// (2) "file" is read
-func fileAccessedOrModified() (uint, uint64) {
-	flags := uint(unix.FAN_CLASS_NOTIF | unix.FD_CLOEXEC)
-	mask := uint64(unix.FAN_ACCESS | unix.FAN_MODIFY | unix.FAN_EVENT_ON_CHILD)
-	return flags, mask
-}
+	// inodeEvents are the events that cannot be filtered by mount point
+	// and hence are rejected by the kernel on mount marks.
+	inodeEvents = unix.FAN_CREATE | unix.FAN_DELETE | unix.FAN_MOVE | unix.FAN_RENAME |
+		unix.FAN_ATTRIB | unix.FAN_DELETE_SELF | unix.FAN_MOVE_SELF
 
-// fileCloseWriteNoWrite raises event when
-// (1) "file" is accessed / read and closed then "close-no-write" is
-// raised.
-// (2) "file" is written or updated and closed then "close-write" is
-// raised.
-// NOTE multiple close-no-writes are raised for files opened by editors
-func fileCloseWriteNoWrite() (uint, uint64) {
-	flags := uint(unix.FAN_CLASS_NOTIF | unix.FD_CLOEXEC)
-	mask := uint64(unix.FAN_CLOSE_WRITE | unix.FAN_CLOSE_NOWRITE | unix.FAN_EVENT_ON_CHILD)
-	return flags, mask
-}
+	// goneEvents are the events whose object may no longer exist by the
+	// time it is resolved, making OpenByHandleAt fail with ESTALE.
+	goneEvents = unix.FAN_DELETE | unix.FAN_DELETE_SELF | unix.FAN_MOVED_FROM
+)
 
-// fileOpenExec raises event when
-// (1) if "file" is opened raises FAN_OPEN
-// (2) if "file" is executed raises FAN_OPEN and FAN_OPEN_EXEC
-func fileOpenExec() (uint, uint64) {
+// initFlagsFor returns the init flags needed to watch the events in mask:
+// permission events need FAN_CLASS_CONTENT, the inode events are only
+// reported along with file handles and FAN_RENAME also needs the names.
+func initFlagsFor(mask uint64) uint {
 	flags := uint(unix.FAN_CLASS_NOTIF | unix.FD_CLOEXEC)
-	mask := uint64(unix.FAN_OPEN | unix.FAN_OPEN_EXEC | unix.FAN_EVENT_ON_CHILD)
-	return flags, mask
+	if mask&permissionEvents != 0 {
+		flags |= unix.FAN_CLASS_CONTENT
+	}
+	if mask&(inodeEvents|unix.FAN_FS_ERROR) != 0 {
+		flags |= unix.FAN_REPORT_FID
+	}
+	if mask&unix.FAN_RENAME != 0 {
+		// both entries are reported as directory handle and name
+		flags |= unix.FAN_REPORT_DFID_NAME
+	}
+	return flags
 }
 
-// fileAttribChange raises event when file's attribute is changed
-// NOTE does not detect changes to extended attributes
-func fileAttribChange() (uint, uint64) {
-	flags := uint(unix.FAN_CLASS_NOTIF | unix.FD_CLOEXEC | unix.FAN_REPORT_FID)
-	mask := uint64(unix.FAN_ATTRIB | unix.FAN_EVENT_ON_CHILD)
-	return flags, mask
+func FanotifyEventOK(meta *unix.FanotifyEventMetadata, n int) bool {
+	return (n >= int(SizeOfFanotifyEventMetadata) &&
+		meta.Event_len >= SizeOfFanotifyEventMetadata &&
+		int(meta.Event_len) <= n)
 }
 
-// fileOrDirCreated raises event when "file" or "directory" is created under
-// the monitored directory. The FileHandle only has information about the
-// parent path and not the child that was created.
-//
-// NOTE (Caveat) the subdirectory created is not returned. Hence it is not
-// possible to selectively monitor subdirectories. The only
-// option is to use FAN_MARK_MOUNT or FAN_MARK_FILESYSTEM and then selectively
-// ignore
-func fileOrDirCreated() (uint, uint64) {
-	flags := uint(unix.FAN_CLASS_NOTIF | unix.FD_CLOEXEC | unix.FAN_REPORT_FID)
-	mask := uint64(unix.FAN_CREATE | unix.FAN_EVENT_ON_CHILD | unix.FAN_ONDIR)
-	return flags, mask
+// fidRecord is a decoded file identifier info record.
+type fidRecord struct {
+	infoType uint8
+	fsid     kernelFSID
+	handle   *unix.FileHandle
+	name     string
 }
 
-// fileDeleteSelf raises event when
-// (1) file or directory under the marked directory is deleted.
-// (2) the marked directory itself is deleted
-//
-// NOTE (Caveat) when the marked directory is deleted the event
-// file handle becomes stale and the event escapes
-func fileDeleteSelf() (uint, uint64) {
-	flags := uint(unix.FAN_CLASS_NOTIF | unix.FD_CLOEXEC | unix.FAN_REPORT_FID)
-	mask := uint64(unix.FAN_DELETE | unix.FAN_DELETE_SELF | unix.FAN_ONDIR)
-	return flags, mask
+// eventInfo holds the info records decoded from a single event.
+type eventInfo struct {
+	fids []fidRecord
+	// pidfd is the descriptor of a FAN_EVENT_INFO_TYPE_PIDFD record, or
+	// FAN_NOPIDFD when the event carries none, and pidfdError why the
+	// record carries none.
+	pidfd      int32
+	pidfdError error
+	// fsError is the FAN_EVENT_INFO_TYPE_ERROR record, nil if none.
+	fsError *FanotifyEventInfoError
 }
 
-func MaskValues(m uint64) []string {
-	return mask(m, true)
+// getInfoRecords walks the info records stored in buf[off:end], that is
+// between the event metadata and the end of the event, and decodes the file
+// identifier, pidfd and error records among them. Records of other types
+// are skipped.
+func getInfoRecords(buf []byte, off, end int) (eventInfo, error) {
+	info := eventInfo{pidfd: unix.FAN_NOPIDFD}
+
+	sizeOfFanotifyEventInfoHeader := int(unsafe.Sizeof(FanotifyEventInfoHeader{}))
+	for off+sizeOfFanotifyEventInfoHeader <= end {
+		header := (*FanotifyEventInfoHeader)(unsafe.Pointer(&buf[off]))
+		if header.Len == 0 || off+int(header.Len) > end {
+			return info, fmt.Errorf("%w: info record length %d", ErrInvalidData, header.Len)
+		}
+		switch header.InfoType {
+		case unix.FAN_EVENT_INFO_TYPE_FID,
+			unix.FAN_EVENT_INFO_TYPE_DFID,
+			unix.FAN_EVENT_INFO_TYPE_DFID_NAME,
+			unix.FAN_EVENT_INFO_TYPE_OLD_DFID_NAME,
+			unix.FAN_EVENT_INFO_TYPE_NEW_DFID_NAME:
+			handle, name, err := getFileHandle(buf, off)
+			if err != nil {
+				return info, err
+			}
+			info.fids = append(info.fids, fidRecord{
+				infoType: header.InfoType,
+				fsid:     *(*kernelFSID)(unsafe.Pointer(&buf[off+fidFSIDOffset])),
+				handle:   handle,
+				name:     name,
+			})
+		case unix.FAN_EVENT_INFO_TYPE_PIDFD:
+			if int(header.Len) < int(unsafe.Sizeof(FanotifyEventInfoPidfd{})) {
+				return info, fmt.Errorf("%w: pidfd record length %d", ErrInvalidData, header.Len)
+			}
+			info.pidfd = (*FanotifyEventInfoPidfd)(unsafe.Pointer(&buf[off])).Pidfd
+			// the sentinels are not descriptors to be closed
+			switch info.pidfd {
+			case unix.FAN_NOPIDFD:
+				info.pidfdError = unix.ESRCH
+			case unix.FAN_EPIDFD:
+				info.pidfd, info.pidfdError = unix.FAN_NOPIDFD, ErrPidfdUnavailable
+			default:
+				if info.pidfd < 0 {
+					info.pidfd, info.pidfdError = unix.FAN_NOPIDFD, ErrPidfdUnavailable
+				}
+			}
+		case unix.FAN_EVENT_INFO_TYPE_ERROR:
+			if int(header.Len) < int(unsafe.Sizeof(FanotifyEventInfoError{})) {
+				return info, fmt.Errorf("%w: error record length %d", ErrInvalidData, header.Len)
+			}
+			rec := *(*FanotifyEventInfoError)(unsafe.Pointer(&buf[off]))
+			info.fsError = &rec
+		}
+		off += int(header.Len)
+	}
+	return info, nil
 }
 
-func MaskDescriptions(m uint64) []string {
-	return mask(m, false)
+// primaryRecord returns the record identifying the object an event refers
+// to: the entry named by a DFID_NAME record (the new name for renames), the
+// object itself for FID records or else its parent directory. The old name
+// of a rename is used only if the new one was not reported.
+func primaryRecord(records []fidRecord) (fidRecord, bool) {
+	for _, infoType := range []uint8{
+		unix.FAN_EVENT_INFO_TYPE_NEW_DFID_NAME,
+		unix.FAN_EVENT_INFO_TYPE_DFID_NAME,
+		unix.FAN_EVENT_INFO_TYPE_FID,
+		unix.FAN_EVENT_INFO_TYPE_DFID,
+		unix.FAN_EVENT_INFO_TYPE_OLD_DFID_NAME,
+	} {
+		for _, rec := range records {
+			if rec.infoType == infoType {
+				return rec, true
+			}
+		}
+	}
+	return fidRecord{}, false
 }
 
-func mask(mask uint64, values bool) []string {
-	var maskTable = map[int]struct {
-		value string
-		desc  string
-	}{
-		unix.FAN_ACCESS: {
-			"access",
-			"Create an event when a file or directory (but see BUGS) is accessed (read)",
-		},
-		unix.FAN_MODIFY: {
-			"modify",
-			"Create an event when a file is modified (write).",
-		},
-		unix.FAN_ONDIR: {
-			"ondir",
-			"Create events for directories when readdir, opendir, closedir are called",
-		},
-		unix.FAN_EVENT_ON_CHILD: {
-			"onchild",
-			"Events for the immediate children of marked directories shall be created",
-		},
-		unix.FAN_CLOSE_WRITE: {
-			"close-write",
-			"Create an event when a writable file is closed.",
-		},
-		unix.FAN_CLOSE_NOWRITE: {
-			"close-no-write",
-			"Create an event when a read-only file or directory is closed.",
-		},
-		unix.FAN_OPEN: {
-			"open",
-			"Create an event when a file or directory is opened.",
-		},
-		unix.FAN_OPEN_EXEC: {
-			"exec",
-			"Create an event when a file is opened with the intent to be executed.",
-		},
-		unix.FAN_ATTRIB: {
-			"attrib",
-			"Create an event when the metadata for a file or directory has changed.",
-		},
-		unix.FAN_CREATE: {
-			"create",
-			"Create an event when a file or directory has been created in a marked parent directory.",
-		},
-		unix.FAN_DELETE: {
-			"delete",
-			"Create an event when a file or directory has been deleted in a marked parent directory.",
-		},
-		unix.FAN_DELETE_SELF: {
-			"delete-self",
-			"Create an event when a marked file or directory itself is deleted.",
-		},
-		unix.FAN_MOVED_FROM: {
-			"moved-from",
-			"Create an event when a file or directory has been moved from a marked parent directory.",
-		},
-		unix.FAN_MOVED_TO: {
-			"moved-to",
-			"Create an event when a file or directory has been moved to a marked parent directory.",
-		},
-		unix.FAN_MOVE_SELF: {
-			"move-self",
-			"Create an event when a marked file or directory itself has been moved.",
-		},
-	}
-	maskValues := func(m uint64) []string {
-		var ret []string
-		for k, v := range maskTable {
-			if m&uint64(k) != 0 {
-				if values {
-					ret = append(ret, v.value)
-				} else {
-					ret = append(ret, v.desc)
-				}
+// getFileHandle decodes the file handle of the FID info record at buf[off].
+// For records of the DFID_NAME family it also returns the null terminated
+// name stored after the handle; the name is empty for plain FID records.
+// The handle must fit within the length of the record, which the caller
+// checked against the end of the event.
+func getFileHandle(buf []byte, off int) (*unix.FileHandle, string, error) {
+	header := (*FanotifyEventInfoHeader)(unsafe.Pointer(&buf[off]))
+	end := off + int(header.Len)
+
+	// the fields are in host byte order
+	h := off + fidHandleOffset
+	if h+handleDataOffset > end {
+		return nil, "", fmt.Errorf("%w: file identifier record length %d", ErrInvalidData, header.Len)
+	}
+	fhSize := *(*uint32)(unsafe.Pointer(&buf[h+handleSizeOffset]))
+	fhType := *(*int32)(unsafe.Pointer(&buf[h+handleTypeOffset]))
+	j := h + handleDataOffset
+	if fhSize > uint32(end-j) {
+		return nil, "", fmt.Errorf("%w: file handle size %d exceeds record length %d", ErrInvalidData, fhSize, header.Len)
+	}
+	handle := unix.NewFileHandle(fhType, buf[j:j+int(fhSize)])
+	j += int(fhSize)
+	var name string
+	switch header.InfoType {
+	case unix.FAN_EVENT_INFO_TYPE_DFID_NAME,
+		unix.FAN_EVENT_INFO_TYPE_OLD_DFID_NAME,
+		unix.FAN_EVENT_INFO_TYPE_NEW_DFID_NAME:
+		if j < end {
+			b := buf[j:end]
+			if k := bytes.IndexByte(b, 0); k >= 0 {
+				b = b[:k]
 			}
+			name = string(b)
 		}
-		return ret
 	}
-	return maskValues(mask)
+	return &handle, name, nil
 }
 
-// watch watches only the specified directory
-func watch(watchDir string) {
-	var fd int
+// resolve returns the path of the object identified by rec, joined with the
+// record's name when it carries one.
+func (w *Watcher) resolve(rec fidRecord, name []byte) (string, error) {
+	// O_PATH also opens symlinks, marked with FAN_MARK_DONT_FOLLOW
+	fd, err := w.openHandle(rec, unix.O_PATH)
+	if err != nil {
+		return "", err
+	}
+	defer unix.Close(fd)
+	n, err := w.readFdLink(fd, name)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(string(name[:n]), rec.name), nil
+}
 
-	initFlags, markMaskFlags = fileDeleteSelf()
+// resolveFile is resolve keeping the object identified by rec open, see
+// WatchOptions.OpenHandles. Only regular files and directories are opened,
+// as opening a FIFO blocks until a writer shows up and opening a device may
+// have side effects. The file is nil for other objects and for those that
+// cannot be opened for reading, whose path is still resolved.
+func (w *Watcher) resolveFile(rec fidRecord, name []byte) (string, *os.File, error) {
+	fd, err := w.openHandle(rec, unix.O_PATH)
+	if err != nil {
+		return "", nil, err
+	}
+	defer unix.Close(fd)
+	n, err := w.readFdLink(fd, name)
+	if err != nil {
+		return "", nil, err
+	}
+	dir := string(name[:n])
+	path := filepath.Join(dir, rec.name)
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil {
+		w.logger.Debugf("no file for %s: %v", path, newSyscallError("Fstat", dir, err))
+		return path, nil, nil
+	}
+	if mode := st.Mode & unix.S_IFMT; mode != unix.S_IFREG && mode != unix.S_IFDIR {
+		return path, nil, nil
+	}
+	file, err := w.openHandle(rec, unix.O_RDONLY|unix.O_NONBLOCK)
+	if err != nil {
+		// e.g. EACCES, the event is still worth delivering
+		w.logger.Debugf("no file for %s: %v", path, err)
+		return path, nil, nil
+	}
+	return path, os.NewFile(uintptr(file), dir), nil
+}
 
-	// initialize fanotify certain flags need CAP_SYS_ADMIN
-	initFileStatusFlags = unix.O_RDONLY | unix.O_CLOEXEC | unix.O_LARGEFILE
-	fd, errno := unix.FanotifyInit(initFlags, initFileStatusFlags)
+// openHandle opens the object identified by rec with flags through a mount
+// of its filesystem.
+func (w *Watcher) openHandle(rec fidRecord, flags int) (int, error) {
+	mountFd, err := w.mountFd(rec.fsid)
+	if err != nil {
+		return -1, err
+	}
+	var fd int
+	errno := ignoringEINTR(func() (err error) {
+		fd, err = unix.OpenByHandleAt(mountFd, *rec.handle, flags|unix.O_CLOEXEC)
+		return err
+	})
 	if errno != nil {
-		log.Fatalf("FanotifyInit: %v", errno)
+		return -1, newSyscallError("OpenByHandleAt", "", errno)
 	}
+	return fd, nil
+}
 
-	// fanotify_mark
-	markFlags = unix.FAN_MARK_ADD
-	desc := MaskDescriptions(markMaskFlags)
-	errno = unix.FanotifyMark(fd, markFlags, markMaskFlags, -1, watchDir)
-	if errno != nil {
-		log.Fatalf("FanotifyMark: %v", errno)
+// renameOf returns the old and new entry names of a FAN_RENAME event, the
+// directories are filled in by resolveRename.
+func renameOf(records []fidRecord) *RenameEvent {
+	var r RenameEvent
+	for _, rec := range records {
+		switch rec.infoType {
+		case unix.FAN_EVENT_INFO_TYPE_OLD_DFID_NAME:
+			r.OldName = rec.name
+		case unix.FAN_EVENT_INFO_TYPE_NEW_DFID_NAME:
+			r.NewName = rec.name
+		}
 	}
-	// poll for events
-	var fds [1]unix.PollFd
-	fds[0].Fd = int32(fd)
-	fds[0].Events = unix.POLLIN
+	return &r
+}
 
-	// determine mount_id
-	_, mountID, errno := unix.NameToHandleAt(-1, watchDir, unix.AT_SYMLINK_FOLLOW)
-	if errno != nil {
-		log.Fatalf("NameToHandleAt:", errno)
+// resolveRename resolves the old and new directories of a FAN_RENAME event
+// into r. A directory that cannot be resolved, e.g. because it was removed
+// in the meantime, is left empty.
+func (w *Watcher) resolveRename(r *RenameEvent, records []fidRecord, name []byte) {
+	for _, rec := range records {
+		var dir *string
+		switch rec.infoType {
+		case unix.FAN_EVENT_INFO_TYPE_OLD_DFID_NAME:
+			dir = &r.OldDir
+		case unix.FAN_EVENT_INFO_TYPE_NEW_DFID_NAME:
+			dir = &r.NewDir
+		default:
+			continue
+		}
+		*dir, _ = w.resolve(fidRecord{fsid: rec.fsid, handle: rec.handle}, name)
 	}
+}
 
-	// get mount_fd from the mount_id
-	mountInfo, err := os.Open("/proc/self/mountinfo")
-	if err != nil {
-		log.Fatalf("Error opening /proc/self/mountinfo:", err)
-	}
-	scanner := bufio.NewScanner(mountInfo)
-	scanner.Split(bufio.ScanLines)
-	var lines []string
-	for scanner.Scan() {
-		lines = append(lines, scanner.Text())
-	}
-	mountInfo.Close()
-
-	var mountPoint string
-	for _, line := range lines {
-		toks := strings.Split(line, " ")
-		if toks[0] == strconv.Itoa(mountID) {
-			log.Println("Found mount entry:", line)
-			mountPoint = toks[4] // 5th entry is the mount point
-			break
+// resolveGone returns the best path for an object that no longer exists:
+// its name joined to the first parent directory record that still resolves,
+// or just the name when none does. The result is empty for FID records
+// without a name whose parent is gone too.
+func (w *Watcher) resolveGone(records []fidRecord, name []byte) string {
+	var entry string
+	for _, rec := range records {
+		if rec.name != "" && entry == "" {
+			entry = rec.name
+		}
+		if rec.infoType != unix.FAN_EVENT_INFO_TYPE_DFID_NAME && rec.infoType != unix.FAN_EVENT_INFO_TYPE_DFID {
+			continue
+		}
+		if path, err := w.resolve(rec, name); err == nil {
+			return path
 		}
 	}
-	mountFd, err := unix.Open(mountPoint, unix.O_RDONLY|unix.O_DIRECTORY, unix.S_IRUSR)
+	return entry
+}
+
+// readFdLink reads the target of /proc/self/fd/<fd> into name. The link
+// path is built in w.procPath and passed to readlinkat directly, so that
+// resolving an event does not allocate.
+func (w *Watcher) readFdLink(fd int, name []byte) (int, error) {
+	p := append(w.procPath[:0], "/proc/self/fd/"...)
+	p = strconv.AppendInt(p, int64(fd), 10)
+	p = append(p, 0)
+	w.procPath = p
+	dirfd := unix.AT_FDCWD
+	var n uintptr
+	err := ignoringEINTR(func() error {
+		var errno unix.Errno
+		n, _, errno = unix.Syscall6(unix.SYS_READLINKAT, uintptr(dirfd),
+			uintptr(unsafe.Pointer(&p[0])), uintptr(unsafe.Pointer(&name[0])), uintptr(len(name)), 0, 0)
+		if errno != 0 {
+			return errno
+		}
+		return nil
+	})
+	if err == unix.ENOENT {
+		// fd is open, so it is its /proc entry that is missing
+		return 0, fmt.Errorf("%w: %v", ErrProcUnavailable, newSyscallError("Readlink", string(p[:len(p)-1]), err))
+	}
 	if err != nil {
-		log.Fatalf("Error opening:", mountPoint, err)
+		return 0, newSyscallError("Readlink", string(p[:len(p)-1]), err)
 	}
+	return int(n), nil
+}
 
-	log.Println("Listening to events on", watchDir)
-	for _, d := range desc {
-		log.Println(d)
+// readEvents reads the events available on the fanotify descriptor and
+// appends those to deliver, resolved and prepared, to batch. Events decoded
+// before an error are returned along with it.
+func (w *Watcher) readEvents(batch []Event) ([]Event, error) {
+	// an incomplete event left by the previous read is kept at the front
+	// of buf, read the rest of it behind
+	buf := w.buf
+	var n int
+	errno := ignoringEINTR(func() (err error) {
+		n, err = w.sys.Read(w.fd, buf[w.partial:])
+		return err
+	})
+	w.readTime = time.Now()
+	switch {
+	case errno == unix.EAGAIN:
+		// FAN_NONBLOCK and the queue was drained, wait for epoll again
+		return batch, nil
+	case errno == unix.EINVAL:
+		// the kernel does not split events, see MinBufferSize
+		return batch, fmt.Errorf("event does not fit in %d bytes: %w", len(buf)-w.partial, newSyscallError("Read", "", errno))
+	case errno != nil:
+		return batch, newSyscallError("Read", "", errno)
+	case n == 0:
+		return batch, io.EOF
 	}
+	n += w.partial
+	off := 0
 	for {
-		n, errno := unix.Poll(fds[:], -1) // blocking
-		if n == 0 {
-			continue
-		}
-		if errno != nil {
-			if errno == unix.EINTR {
-				continue
+		events, i, err := decodeEvents(w.decoded[:0], buf[off:n], w.initFlags)
+		off += i
+		for _, ev := range events {
+			w.seq++
+			ev.Seq = w.seq
+			ev.Values = w.maskValues(ev.Mask)
+			if ev, ok := w.handleEvent(ev, w.name); ok {
+				batch = append(batch, ev)
 			}
-			log.Fatalf("Poll: %v", errno)
 		}
-		readEvents(fd, mountFd)
+		// the scratch space must not keep the records of the events alive
+		clear(events)
+		w.decoded = events[:0]
+		if err == nil {
+			break
+		}
+		atomic.AddUint64(&w.stats.decodeErrors, 1)
+		// release what could be decoded of the offending event
+		ev, _ := decodeEvent(buf[off:n], w.initFlags)
+		w.discard(ev)
+		// skip the event if its length can be trusted, the layout of
+		// the events is unknown if the version does not match
+		var verr *MetadataVersionError
+		size, ok := eventLen(buf[off:n])
+		if !ok || errors.As(err, &verr) {
+			return batch, err
+		}
+		w.reportError(err)
+		off += size
+	}
+	w.partial = copy(buf, buf[off:n])
+	if w.partial == len(buf) {
+		return batch, fmt.Errorf("%w: event does not fit in %d bytes", ErrBufferTooSmall, len(buf))
 	}
+	return batch, nil
 }
 
-func FanotifyEventOK(meta *unix.FanotifyEventMetadata, n int) bool {
-	return (n >= int(SizeOfFanotifyEventMetadata) &&
-		meta.Event_len >= SizeOfFanotifyEventMetadata &&
-		int(meta.Event_len) <= n)
+// eventLen returns the length of the event at the start of buf, reporting
+// false if its metadata is incomplete or inconsistent.
+func eventLen(buf []byte) (int, bool) {
+	if len(buf) < int(SizeOfFanotifyEventMetadata) {
+		return 0, false
+	}
+	metadata := (*unix.FanotifyEventMetadata)(unsafe.Pointer(&buf[0]))
+	if !FanotifyEventOK(metadata, len(buf)) {
+		return 0, false
+	}
+	return int(metadata.Event_len), true
 }
 
-func getFileHandle(metadataLen uint16, buf []byte, i int) *unix.FileHandle {
-	var fhSize uint32
-	var fhType int32
-
-	sizeOfFanotifyEventInfoHeader := uint32(unsafe.Sizeof(FanotifyEventInfoHeader{}))
-	sizeOfKernelFSIDType := uint32(unsafe.Sizeof(kernelFSID{}))
-	sizeOfUint32 := uint32(unsafe.Sizeof(fhSize))
-	j := uint32(i) + uint32(metadataLen) + sizeOfFanotifyEventInfoHeader + sizeOfKernelFSIDType
-	binary.Read(bytes.NewReader(buf[j:j+sizeOfUint32]), binary.LittleEndian, &fhSize)
-	j += sizeOfUint32
-	binary.Read(bytes.NewReader(buf[j:j+sizeOfUint32]), binary.LittleEndian, &fhType)
-	j += sizeOfUint32
-	handle := unix.NewFileHandle(fhType, buf[j:j+fhSize])
-	return &handle
+// maskValues returns MaskValues(m), shared by the events read with the same
+// mask so that the read loop does not allocate the names for every event.
+func (w *Watcher) maskValues(m uint64) []string {
+	v, ok := w.values[m]
+	if !ok {
+		v = MaskValues(m)
+		w.values[m] = v
+	}
+	return v
 }
 
-func readEvents(fd, mountFd int) error {
-	var fid *FanotifyEventInfoFID
-	var buf [4096 * SizeOfFanotifyEventMetadata]byte
-	var metadata *unix.FanotifyEventMetadata
-	var name [unix.PathMax]byte
+// DecodeEvents decodes the events stored in buf, as read from a fanotify
+// descriptor initialized with initFlags, and returns them along with the
+// number of bytes they took up. An incomplete event at the end of buf is
+// not consumed, it is completed by a further read.
+//
+// Decoding involves no system calls: paths are not resolved, so in
+// FAN_REPORT_FID mode the events carry Handle, FSID and Name and the
+// names of Rename only. The descriptors in Fd and PidFd are passed on
+// unchanged. On error the events preceding the offending one are returned,
+// and the offset of that event in place of the number of bytes consumed.
+func DecodeEvents(buf []byte, initFlags uint) ([]Event, int, error) {
+	events, i, err := decodeEvents(nil, buf, initFlags)
+	for j := range events {
+		events[j].Values = MaskValues(events[j].Mask)
+	}
+	return events, i, err
+}
 
-	for {
-		n, errno := unix.Read(fd, buf[:])
-		if errno == unix.EINTR {
-			continue
+// decodeEvents is DecodeEvents appending the events to events, leaving their
+// Values to the caller.
+func decodeEvents(events []Event, buf []byte, initFlags uint) ([]Event, int, error) {
+	i := 0
+	for i < len(buf) {
+		metadata := (*unix.FanotifyEventMetadata)(unsafe.Pointer(&buf[i]))
+		if !FanotifyEventOK(metadata, len(buf)-i) {
+			if len(buf)-i >= int(SizeOfFanotifyEventMetadata) && metadata.Event_len < SizeOfFanotifyEventMetadata {
+				return events, i, fmt.Errorf("%w: event length %d", ErrInvalidData, metadata.Event_len)
+			}
+			break
+		}
+		ev, err := decodeEvent(buf[i:i+int(metadata.Event_len)], initFlags)
+		if err != nil {
+			return events, i, err
+		}
+		events = append(events, ev)
+		i += int(metadata.Event_len)
+	}
+	return events, i, nil
+}
+
+// decodeEvent decodes the single event held in buf. On error the returned
+// event still holds the descriptors decoded so far, for the caller to
+// release.
+func decodeEvent(buf []byte, initFlags uint) (Event, error) {
+	none := Event{Fd: unix.FAN_NOFD, PidFd: unix.FAN_NOPIDFD}
+	if len(buf) < int(SizeOfFanotifyEventMetadata) {
+		return none, fmt.Errorf("%w: event length %d", ErrInvalidData, len(buf))
+	}
+	metadata := (*unix.FanotifyEventMetadata)(unsafe.Pointer(&buf[0]))
+	if !FanotifyEventOK(metadata, len(buf)) {
+		return none, fmt.Errorf("%w: event length %d", ErrInvalidData, metadata.Event_len)
+	}
+	buf = buf[:metadata.Event_len]
+	if metadata.Vers != unix.FANOTIFY_METADATA_VERSION {
+		// the layout is unknown, so are the descriptors
+		return none, &MetadataVersionError{Kernel: metadata.Vers, Compiled: unix.FANOTIFY_METADATA_VERSION}
+	}
+	if metadata.Mask&unix.FAN_Q_OVERFLOW != 0 {
+		// events were dropped, there is no object to resolve
+		ev := newEvent(metadata, unix.FAN_NOPIDFD, "")
+		ev.Overflow = true
+		return ev, nil
+	}
+	// info records start at Metadata_len, which a newer kernel may report
+	// larger than the struct known here, and end with the event
+	if uint32(metadata.Metadata_len) < SizeOfFanotifyEventMetadata || uint32(metadata.Metadata_len) > metadata.Event_len {
+		// the descriptor is still valid, for the caller to release
+		return newEvent(metadata, unix.FAN_NOPIDFD, ""), fmt.Errorf("%w: metadata length %d of event length %d", ErrInvalidData, metadata.Metadata_len, metadata.Event_len)
+	}
+	info, err := getInfoRecords(buf, int(metadata.Metadata_len), len(buf))
+	ev := newEvent(metadata, info.pidfd, "")
+	ev.PidFdError = info.pidfdError
+	if rec := info.fsError; rec != nil {
+		errno := rec.Error
+		if errno < 0 {
+			errno = -errno
+		}
+		ev.FSError = unix.Errno(errno)
+		ev.FSErrorCount = rec.ErrorCount
+	}
+	if initFlags&FAN_REPORT_FD_ERROR != 0 && initFlags&reportFIDFlags == 0 && ev.Fd < 0 {
+		// the kernel failed to open the object, FAN_NOFD reads as EPERM
+		ev.FdError = unix.Errno(-ev.Fd)
+		ev.Fd = unix.FAN_NOFD
+	}
+	if err != nil {
+		return ev, err
+	}
+	if initFlags&reportFIDFlags == 0 {
+		return ev, nil
+	}
+	// If FanotifyInit was initialized with FAN_REPORT_FID then
+	// expect metadata.Fd to be FAN_NOFD
+	if metadata.Fd != unix.FAN_NOFD {
+		return ev, fmt.Errorf("%w: unexpected fd %d with FAN_REPORT_FID", ErrInvalidData, metadata.Fd)
+	}
+	rec, ok := primaryRecord(info.fids)
+	if !ok {
+		return ev, fmt.Errorf("%w: no file identifier record", ErrInvalidData)
+	}
+	ev.Name = rec.name
+	ev.Handle = rec.handle
+	ev.FSID = unix.Fsid{Val: rec.fsid.val}
+	if metadata.Mask&unix.FAN_RENAME != 0 {
+		ev.Rename = renameOf(info.fids)
+	}
+	ev.records = info.fids
+	return ev, nil
+}
+
+// discard releases the descriptors of an event that is not delivered,
+// allowing it first if it is a permission event.
+func (w *Watcher) discard(ev Event) {
+	if ev.ResponseRequired {
+		w.Respond(ev.Fd, true)
+	}
+	ev.Close()
+}
+
+// handleEvent resolves the path of a decoded event and prepares it for
+// delivery, reporting whether it is to be delivered. name is scratch space
+// for resolving paths.
+func (w *Watcher) handleEvent(ev Event, name []byte) (Event, bool) {
+	if !ev.Overflow && w.ignoresPid(ev.Pid) {
+		// dropped before its path is resolved
+		w.discard(ev)
+		return ev, false
+	}
+	switch {
+	case ev.Overflow:
+		atomic.AddUint64(&w.stats.overflows, 1)
+	case w.initFlags&reportFIDFlags != 0:
+		rec, _ := primaryRecord(ev.records)
+		if w.debug {
+			// boxing the arguments allocates even if they are discarded
+			w.logger.Debugf("Handle type (%d), size (%d), bytes (%v)", rec.handle.Type(), rec.handle.Size(), rec.handle.Bytes())
+		}
+		var path string
+		var err error
+		if w.openHandles {
+			path, ev.HandleFile, err = w.resolveFile(rec, name)
+		} else {
+			path, err = w.resolve(rec, name)
+		}
+		if errors.Is(err, unix.ESTALE) && ev.Mask&goneEvents != 0 {
+			// the object is already gone, which is expected for these
+			// events, so report whatever its parent records still tell
+			path, err = w.resolveGone(ev.records, name), nil
+		}
+		if err != nil {
+			atomic.AddUint64(&w.stats.resolveErrors, 1)
 		}
 		switch {
-		case n == 0:
-			return io.EOF
-		case n < int(SizeOfFanotifyEventMetadata):
-			return ErrInvalidData
-		case errno != nil:
-			return errno
+		case err != nil && ev.FSError != nil:
+			// the error may concern the whole filesystem rather than
+			// an object, whose handle is then invalid
+			w.logger.Debugf("no path for filesystem error: %v", err)
+		case errors.Is(err, ErrProcUnavailable) && ev.Name != "":
+			// the entry name still tells the consumer something, who
+			// may resolve ev.Handle by other means
+			w.reportError(err)
+		case err != nil:
+			w.reportError(err)
+			ev.Close()
+			return ev, false
 		}
-		i := 0
-		metadata = (*unix.FanotifyEventMetadata)(unsafe.Pointer(&buf[i]))
-		for FanotifyEventOK(metadata, n) {
-			if metadata.Vers != unix.FANOTIFY_METADATA_VERSION {
-				log.Fatalf("Incompatible fanotify version. Rebuild your code.")
-			}
-			// If FanotifyInit was initialized with FAN_REPORT_FID then
-			// expect metadata.Fd to be FAN_NOFD
-			if initFlags&unix.FAN_REPORT_FID != 0 && metadata.Fd != unix.FAN_NOFD {
-				log.Fatalf("Error FanotifyInit called with FAN_REPORT_FID. Unexpected Fd:", metadata.Fd)
-			}
-			if initFlags&unix.FAN_REPORT_FID != 0 {
-				log.Print("init flag has FAN_REPORT_FID set.")
-				fid = (*FanotifyEventInfoFID)(unsafe.Pointer(&buf[i+int(metadata.Metadata_len)]))
-				handle := getFileHandle(metadata.Metadata_len, buf[:], i)
-				log.Printf("Handle type (%d), size (%d), bytes (%v)", handle.Type(), handle.Size(), handle.Bytes())
-				if fid.Header.InfoType == unix.FAN_EVENT_INFO_TYPE_FID {
-					fd, errno := unix.OpenByHandleAt(mountFd, *handle, unix.O_RDONLY)
-					if errno != nil {
-						log.Println("OpenByHandleAt:", errno)
-						i += int(metadata.Event_len)
-						n -= int(metadata.Event_len)
-						metadata = (*unix.FanotifyEventMetadata)(unsafe.Pointer(&buf[i]))
-						continue
-					}
-					fdPath := fmt.Sprintf("/proc/self/fd/%d", fd)
-					n1, errno := unix.Readlink(fdPath, name[:])
-					log.Printf("Path: %s; Mask: %s", string(name[:n1]), MaskValues(metadata.Mask))
-					unix.Close(fd)
-				} else {
-					log.Fatalf("Unexpected InfoType %d expected %d", fid.Header.InfoType, unix.FAN_EVENT_INFO_TYPE_FID)
-				}
-			}
-			if metadata.Fd != unix.FAN_NOFD {
-				log.Print("init flag does not have FAN_REPORT_FID set.")
-				procFdPath := fmt.Sprintf("/proc/self/fd/%d", metadata.Fd)
-				n1, errno := unix.Readlink(procFdPath, name[:])
-				if errno != nil {
-					log.Fatalf("Readlink for path %s failed %v", procFdPath, errno)
-				}
-				log.Printf("Path: %s; Mask: %s", string(name[:n1]), MaskValues(metadata.Mask))
-			}
-			i += int(metadata.Event_len)
-			n -= int(metadata.Event_len)
-			metadata = (*unix.FanotifyEventMetadata)(unsafe.Pointer(&buf[i]))
+		ev.Path = path
+		if m, ok := w.mountOf(rec.fsid); ok {
+			ev.MountPoint, ev.Dev = m.mountPoint, m.dev
+		}
+		if ev.Rename != nil {
+			w.resolveRename(ev.Rename, ev.records, name)
+		}
+		if ev.Mask&selfEvents != 0 {
+			w.selfEvent(&ev, rec)
+		}
+		if w.tree != nil && !w.followTree(ev) {
+			ev.Close()
+			return ev, false
+		}
+	case ev.Fd != unix.FAN_NOFD:
+		n, err := w.readFdLink(int(ev.Fd), name)
+		if err != nil {
+			atomic.AddUint64(&w.stats.resolveErrors, 1)
+			w.reportError(err)
+			w.discard(ev)
+			return ev, false
+		}
+		ev.Path = string(name[:n])
+	case ev.FdError != nil:
+		// delivered without a path, so the consumer learns about it
+		w.logger.Debugf("no descriptor for event: %v", ev.FdError)
+		if ev.Mask&permissionEvents != 0 {
+			w.reportError(fmt.Errorf("%w: %v permission event not answered: %v", ErrNoFd, ev.Values, ev.FdError))
+		}
+	default:
+		// neither a descriptor nor a file handle, nothing to report
+		if ev.Mask&permissionEvents != 0 {
+			w.reportError(fmt.Errorf("%w: %v permission event not answered", ErrNoFd, ev.Values))
 		}
+		ev.Close()
+		return ev, false
 	}
+	return w.prepare(ev)
 }
@@ -0,0 +1,235 @@
+//go:build !linux
+// +build !linux
+
+package fanotify
+
+import (
+	"context"
+	"os"
+	"syscall"
+	"time"
+)
+
+// This file lets code using the watcher build on systems without fanotify.
+// The constructors fail with ErrUnsupportedPlatform, so no Watcher is ever
+// returned. Only the fields of the types that do not depend on Linux
+// definitions are declared. The mask helpers, the presets and the event
+// predicates are shared with Linux, see constants.go.
+
+const (
+	// SizeOfFanotifyEventMetadata is the size of struct
+	// fanotify_event_metadata.
+	SizeOfFanotifyEventMetadata = uint32(24)
+
+	// DefaultFileStatusFlags are the file status flags of the file
+	// descriptors opened for events, suitable for NewWatcher.
+	DefaultFileStatusFlags = syscall.O_RDONLY | syscall.O_CLOEXEC
+)
+
+// Watcher is not supported on this platform, see NewWatcher.
+type Watcher struct{}
+
+// WatchOptions configures a Watcher, see the Linux documentation.
+type WatchOptions struct {
+	Flags           uint
+	Class           uint
+	FileStatusFlags uint
+	InheritFds      bool
+	MarkFlags       uint
+	Mask            uint64
+	Filter          func(Event) bool
+	Logger          Logger
+	BufferSize      int
+	OpenHandles     bool
+	ResponseTimeout time.Duration
+	AllowOnTimeout  bool
+	Debounce        time.Duration
+	ManualRead      bool
+	OnTick          func()
+	TickInterval    time.Duration
+}
+
+// Logger is the interface through which a Watcher reports diagnostics.
+type Logger interface {
+	Debugf(format string, v ...interface{})
+	Errorf(format string, v ...interface{})
+}
+
+// Event is a decoded fanotify event, never delivered on this platform.
+type Event struct {
+	Path             string
+	Name             string
+	MountPoint       string
+	Dev              uint64
+	HandleFile       *os.File
+	IsDir            bool
+	Rename           *RenameEvent
+	MarkPath         string
+	MarkRemoved      bool
+	Time             time.Time
+	Seq              uint64
+	Mask             uint64
+	Pid              int32
+	FromSelf         bool
+	Comm             string
+	Cmdline          string
+	PidFd            int32
+	PidFdError       error
+	Values           []string
+	Overflow         bool
+	Fd               int32
+	FdError          error
+	FSError          error
+	FSErrorCount     uint32
+	ResponseRequired bool
+}
+
+// RenameEvent describes a rename reported by FAN_RENAME.
+type RenameEvent struct {
+	OldDir  string
+	OldName string
+	NewDir  string
+	NewName string
+}
+
+// Mark describes a mark added through the watcher.
+type Mark struct {
+	Path        string
+	Scope       uint
+	Mask        uint64
+	IgnoredMask uint64
+}
+
+// IgnoreOptions configures an ignore mark, see AddIgnoreMark.
+type IgnoreOptions struct {
+	SurviveModify bool
+	Legacy        bool
+}
+
+// Features reports which optional fanotify flags the kernel accepts, none
+// on this platform.
+type Features struct {
+	FID            bool
+	DFIDName       bool
+	Pidfd          bool
+	FilesystemMark bool
+	EvictableMark  bool
+	IgnoreMark     bool
+	Rename         bool
+}
+
+// Stats counts what a Watcher has seen since it was created.
+type Stats struct {
+	Events        uint64
+	Overflows     uint64
+	ResolveErrors uint64
+	DecodeErrors  uint64
+}
+
+// NewWatcher returns ErrUnsupportedPlatform.
+func NewWatcher(dir string, flags, fileStatusFlags, markFlags uint, mask uint64, bufferSize int) (*Watcher, error) {
+	return nil, ErrUnsupportedPlatform
+}
+
+// NewWatcherWithOptions returns ErrUnsupportedPlatform.
+func NewWatcherWithOptions(dir string, opts WatchOptions) (*Watcher, error) {
+	return nil, ErrUnsupportedPlatform
+}
+
+// WatchTree returns ErrUnsupportedPlatform.
+func WatchTree(root string, mask uint64) (*Watcher, error) {
+	return nil, ErrUnsupportedPlatform
+}
+
+// WatchFile returns ErrUnsupportedPlatform.
+func WatchFile(path string, mask uint64) (*Watcher, error) {
+	return nil, ErrUnsupportedPlatform
+}
+
+// Supported returns ErrUnsupportedPlatform.
+func Supported() (Features, error) {
+	return Features{}, ErrUnsupportedPlatform
+}
+
+// Validate returns ErrUnsupportedPlatform.
+func Validate(dir string, opts WatchOptions) error {
+	return ErrUnsupportedPlatform
+}
+
+// supportedFeatures reports no features, see Supported.
+func supportedFeatures() Features {
+	return Features{}
+}
+
+// CheckPrivileges returns ErrUnsupportedPlatform.
+func CheckPrivileges() error {
+	return ErrUnsupportedPlatform
+}
+
+// DecodeEvents returns ErrUnsupportedPlatform.
+func DecodeEvents(buf []byte, initFlags uint) ([]Event, int, error) {
+	return nil, 0, ErrUnsupportedPlatform
+}
+
+// The methods below mirror the Linux API. Those of Watcher, which cannot be
+// created, fail with ErrUnsupportedPlatform or return zero values.
+
+func (ev *Event) File() (*os.File, error) { return nil, ErrUnsupportedPlatform }
+
+func (ev *Event) Close() error { return nil }
+
+func (ev *Event) Process() (comm, cmdline string, err error) { return "", "", ErrUnsupportedPlatform }
+
+func (w *Watcher) ReportsTID() bool { return false }
+
+func (w *Watcher) Events() <-chan Event { return nil }
+
+func (w *Watcher) Errors() <-chan error { return nil }
+
+func (w *Watcher) AddMark(path string, mask uint64) error { return ErrUnsupportedPlatform }
+
+func (w *Watcher) AddMarkFlags(path string, flags uint, mask uint64) error {
+	return ErrUnsupportedPlatform
+}
+
+func (w *Watcher) AddMarkFd(dirfd int, mask uint64) error { return ErrUnsupportedPlatform }
+
+func (w *Watcher) AddMarkAt(dirfd int, path string, flags uint, mask uint64) error {
+	return ErrUnsupportedPlatform
+}
+
+func (w *Watcher) RemoveMark(path string, mask uint64) error { return ErrUnsupportedPlatform }
+
+func (w *Watcher) RemoveMarkFlags(path string, flags uint, mask uint64) error {
+	return ErrUnsupportedPlatform
+}
+
+func (w *Watcher) SetMask(path string, mask uint64) (uint64, error) {
+	return 0, ErrUnsupportedPlatform
+}
+
+func (w *Watcher) AddIgnoreMark(path string, mask uint64, opts IgnoreOptions) error {
+	return ErrUnsupportedPlatform
+}
+
+func (w *Watcher) FlushMarks(scope uint) error { return ErrUnsupportedPlatform }
+
+func (w *Watcher) Marks() []Mark { return nil }
+
+func (w *Watcher) Respond(fd int32, allow bool) error { return ErrUnsupportedPlatform }
+
+func (w *Watcher) IgnorePid(pid int) {}
+
+func (w *Watcher) UnignorePid(pid int) {}
+
+func (w *Watcher) Stats() Stats { return Stats{} }
+
+func (w *Watcher) ReadBatch() ([]Event, error) { return nil, ErrUnsupportedPlatform }
+
+func (w *Watcher) Reinit() error { return ErrUnsupportedPlatform }
+
+func (w *Watcher) Err() error { return ErrUnsupportedPlatform }
+
+func (w *Watcher) Run(ctx context.Context) error { return ErrUnsupportedPlatform }
+
+func (w *Watcher) Close() error { return nil }
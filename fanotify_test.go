@@ -0,0 +1,403 @@
+//go:build linux
+// +build linux
+
+package fanotify
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// benchmarkBatch is the number of events fed per read in the benchmarks.
+const benchmarkBatch = 64
+
+// reportAllocsPerEvent reports the allocations per event made since before,
+// as the benchmarks process benchmarkBatch events per iteration.
+func reportAllocsPerEvent(b *testing.B, before *runtime.MemStats) {
+	var after runtime.MemStats
+	runtime.ReadMemStats(&after)
+	b.ReportMetric(float64(after.Mallocs-before.Mallocs)/float64(b.N*benchmarkBatch), "allocs/event")
+}
+
+// eventStream returns count events of varying lengths, every other one
+// carrying a pidfd record, numbered by pid from 1. Each event owns a
+// descriptor of the same file.
+func eventStream(t *testing.T, count int) []byte {
+	fd, _ := openFd(t, "a")
+	defer unix.Close(int(fd))
+	var stream []byte
+	for i := 0; i < count; i++ {
+		dup, err := unix.FcntlInt(uintptr(fd), unix.F_DUPFD_CLOEXEC, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var records [][]byte
+		if i%2 == 1 {
+			records = append(records, rawPidfd(unix.FAN_NOPIDFD))
+		}
+		stream = append(stream, rawEvent(unix.FAN_OPEN, int32(dup), int32(i+1), records...)...)
+	}
+	return stream
+}
+
+// checkStream checks that batch holds the count events of eventStream in
+// order, closing them.
+func checkStream(t *testing.T, batch []Event, count int) {
+	t.Helper()
+	defer func() {
+		for i := range batch {
+			batch[i].Close()
+		}
+	}()
+	if len(batch) != count {
+		t.Fatalf("%d events, want %d", len(batch), count)
+	}
+	for i, ev := range batch {
+		if ev.Pid != int32(i+1) || ev.Mask != unix.FAN_OPEN || filepath.Base(ev.Path) != "a" {
+			t.Fatalf("event %d: pid %d mask %#x path %v", i, ev.Pid, ev.Mask, ev.Path)
+		}
+	}
+}
+
+// TestReadEventsCarryOver reads events cut at every offset into the
+// smallest buffer allowed, so that they straddle reads and the end of the
+// buffer.
+func TestReadEventsCarryOver(t *testing.T) {
+	const count = 200
+	stream := eventStream(t, count)
+	w, f := newFakeWatcher(t, t.TempDir(), WatchOptions{Mask: unix.FAN_OPEN, BufferSize: MinBufferSize, ManualRead: true})
+	var chunks [][]byte
+	for off, size := 0, 1; off < len(stream); off, size = off+size, size%37+1 {
+		chunks = append(chunks, stream[off:min(off+size, len(stream))])
+	}
+	f.feed(t, chunks...)
+	var batch []Event
+	for range chunks {
+		var err error
+		if batch, err = w.readEvents(batch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkStream(t, batch, count)
+	if w.partial != 0 {
+		t.Errorf("%d bytes left over", w.partial)
+	}
+}
+
+// TestReadEventsFullBuffer reads events as a stream filling the buffer on
+// every read, the last event of a read usually being incomplete.
+func TestReadEventsFullBuffer(t *testing.T) {
+	const count = 500
+	w, f := newFakeWatcher(t, t.TempDir(), WatchOptions{Mask: unix.FAN_OPEN, BufferSize: MinBufferSize, ManualRead: true})
+	f.split = true
+	f.feed(t, eventStream(t, count))
+	var batch []Event
+	for reads := 0; len(batch) < count; reads++ {
+		if reads > count {
+			t.Fatalf("%d events after %d reads", len(batch), reads)
+		}
+		var err error
+		if batch, err = w.readEvents(batch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkStream(t, batch, count)
+	if w.partial != 0 {
+		t.Errorf("%d bytes left over", w.partial)
+	}
+}
+
+// inflateMetadata returns ev with extra bytes inserted after the metadata,
+// as reported by a kernel whose struct fanotify_event_metadata is larger
+// than the one known here.
+func inflateMetadata(ev []byte, extra int) []byte {
+	meta := int(SizeOfFanotifyEventMetadata)
+	buf := make([]byte, len(ev)+extra)
+	copy(buf, ev[:meta])
+	for i := meta; i < meta+extra; i++ {
+		buf[i] = 0xff
+	}
+	copy(buf[meta+extra:], ev[meta:])
+	m := (*unix.FanotifyEventMetadata)(unsafe.Pointer(&buf[0]))
+	m.Event_len += uint32(extra)
+	m.Metadata_len += uint16(extra)
+	return buf
+}
+
+func TestDecodeEventsMetadataLen(t *testing.T) {
+	handle := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	fsid := [2]int32{7, 9}
+	fid := rawFID(unix.FAN_EVENT_INFO_TYPE_DFID_NAME, fsid, 1, handle, "name")
+	buf := append(
+		inflateMetadata(rawEvent(unix.FAN_CREATE, unix.FAN_NOFD, 42, fid), 16),
+		rawEvent(unix.FAN_DELETE, unix.FAN_NOFD, 43, fid)...)
+	events, n, err := DecodeEvents(buf, unix.FAN_REPORT_DFID_NAME)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(buf) || len(events) != 2 {
+		t.Fatalf("%d events in %d of %d bytes", len(events), n, len(buf))
+	}
+	for i, ev := range events {
+		if ev.Pid != int32(42+i) || ev.Name != "name" || ev.Handle == nil ||
+			!bytes.Equal(ev.Handle.Bytes(), handle) || ev.FSID.Val != fsid {
+			t.Errorf("event %d: pid %d name %q handle %v fsid %v", i, ev.Pid, ev.Name, ev.Handle, ev.FSID)
+		}
+	}
+}
+
+func TestDecodeEventsInvalidMetadataLen(t *testing.T) {
+	fid := rawFID(unix.FAN_EVENT_INFO_TYPE_FID, [2]int32{1, 2}, 1, []byte{1, 2, 3, 4}, "")
+	for _, c := range []struct {
+		name    string
+		metaLen int
+	}{
+		{"short", int(SizeOfFanotifyEventMetadata) - 8},
+		{"past the event", int(SizeOfFanotifyEventMetadata) + len(fid) + 4},
+		// records would start in the middle of the FID record
+		{"misaligned", int(SizeOfFanotifyEventMetadata) + 4},
+	} {
+		ev := rawEvent(unix.FAN_CREATE, unix.FAN_NOFD, 42, fid)
+		(*unix.FanotifyEventMetadata)(unsafe.Pointer(&ev[0])).Metadata_len = uint16(c.metaLen)
+		if _, _, err := DecodeEvents(ev, unix.FAN_REPORT_FID); !errors.Is(err, ErrInvalidData) {
+			t.Errorf("%s metadata length %d: got %v, want ErrInvalidData", c.name, c.metaLen, err)
+		}
+	}
+}
+
+// withLen sets the length field of the info record rec to n.
+func withLen(rec []byte, n uint16) []byte {
+	binary.NativeEndian.PutUint16(rec[2:], n)
+	return rec
+}
+
+// TestDecodeEventRecords decodes events carrying each type of info record.
+// The pidfds are made up and must not be closed.
+func TestDecodeEventRecords(t *testing.T) {
+	fsid := [2]int32{7, 9}
+	dir := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	for _, c := range []struct {
+		name  string
+		flags uint
+		event []byte
+		check func(Event) bool
+	}{
+		{
+			"filesystem error",
+			unix.FAN_REPORT_FID,
+			rawEvent(unix.FAN_FS_ERROR, unix.FAN_NOFD, 0,
+				rawError(-int32(unix.EIO), 3), rawFID(unix.FAN_EVENT_INFO_TYPE_FID, fsid, 1, dir, "")),
+			func(ev Event) bool {
+				return ev.FSError == unix.EIO && ev.FSErrorCount == 3 && ev.Handle != nil && ev.FSID.Val == fsid
+			},
+		},
+		{
+			"pidfd",
+			unix.FAN_REPORT_PIDFD,
+			rawEvent(unix.FAN_OPEN, unix.FAN_NOFD, 42, rawPidfd(1000)),
+			func(ev Event) bool { return ev.PidFd == 1000 && ev.PidFdError == nil },
+		},
+		{
+			"pidfd of an exited process",
+			unix.FAN_REPORT_PIDFD,
+			rawEvent(unix.FAN_OPEN, unix.FAN_NOFD, 42, rawPidfd(unix.FAN_NOPIDFD)),
+			func(ev Event) bool { return ev.PidFd == unix.FAN_NOPIDFD && ev.PidFdError == unix.ESRCH },
+		},
+		{
+			"pidfd not created",
+			unix.FAN_REPORT_PIDFD,
+			rawEvent(unix.FAN_OPEN, unix.FAN_NOFD, 42, rawPidfd(unix.FAN_EPIDFD)),
+			func(ev Event) bool {
+				return ev.PidFd == unix.FAN_NOPIDFD && errors.Is(ev.PidFdError, ErrPidfdUnavailable)
+			},
+		},
+		{
+			"pidfd with an unknown error",
+			unix.FAN_REPORT_PIDFD,
+			rawEvent(unix.FAN_OPEN, unix.FAN_NOFD, 42, rawPidfd(-5)),
+			func(ev Event) bool {
+				return ev.PidFd == unix.FAN_NOPIDFD && errors.Is(ev.PidFdError, ErrPidfdUnavailable)
+			},
+		},
+		{
+			"descriptor error",
+			FAN_REPORT_FD_ERROR,
+			rawEvent(unix.FAN_OPEN, -int32(unix.EACCES), 42),
+			func(ev Event) bool { return ev.Fd == unix.FAN_NOFD && ev.FdError == unix.EACCES },
+		},
+		{
+			"no descriptor without FAN_REPORT_FD_ERROR",
+			0,
+			rawEvent(unix.FAN_OPEN, unix.FAN_NOFD, 42),
+			func(ev Event) bool { return ev.Fd == unix.FAN_NOFD && ev.FdError == nil },
+		},
+		{
+			"rename",
+			unix.FAN_REPORT_DFID_NAME,
+			rawEvent(unix.FAN_RENAME|unix.FAN_ONDIR, unix.FAN_NOFD, 42,
+				rawFID(unix.FAN_EVENT_INFO_TYPE_OLD_DFID_NAME, fsid, 1, dir, "old"),
+				rawFID(unix.FAN_EVENT_INFO_TYPE_NEW_DFID_NAME, fsid, 1, dir, "new")),
+			func(ev Event) bool {
+				return ev.Rename != nil && *ev.Rename == RenameEvent{OldName: "old", NewName: "new"} &&
+					ev.Name == "new" && ev.IsDir && len(ev.records) == 2
+			},
+		},
+		{
+			"rename out of the marked directories",
+			unix.FAN_REPORT_DFID_NAME,
+			rawEvent(unix.FAN_RENAME, unix.FAN_NOFD, 42,
+				rawFID(unix.FAN_EVENT_INFO_TYPE_OLD_DFID_NAME, fsid, 1, dir, "old")),
+			func(ev Event) bool {
+				return ev.Rename != nil && *ev.Rename == RenameEvent{OldName: "old"} && ev.Name == "old"
+			},
+		},
+		{
+			"unknown record skipped",
+			unix.FAN_REPORT_DFID_NAME,
+			rawEvent(unix.FAN_CREATE, unix.FAN_NOFD, 42,
+				rawRecord(99, []byte{1, 2, 3, 4, 5}),
+				rawFID(unix.FAN_EVENT_INFO_TYPE_DFID_NAME, fsid, 1, dir, "a")),
+			func(ev Event) bool { return ev.Name == "a" && string(ev.Handle.Bytes()) == string(dir) },
+		},
+		{
+			"padding after the name",
+			unix.FAN_REPORT_DFID_NAME,
+			rawEvent(unix.FAN_CREATE, unix.FAN_NOFD, 42,
+				rawRecord(unix.FAN_EVENT_INFO_TYPE_DFID_NAME, append(rawFID(0, fsid, 1, dir, "ab")[4:], 0, 0, 0, 0))),
+			func(ev Event) bool { return ev.Name == "ab" },
+		},
+		{
+			"bytes too few for a record after the last",
+			unix.FAN_REPORT_PIDFD,
+			rawEvent(unix.FAN_OPEN, unix.FAN_NOFD, 42, rawPidfd(1000), []byte{1, 2}),
+			func(ev Event) bool { return ev.PidFd == 1000 },
+		},
+	} {
+		ev, err := decodeEvent(c.event, c.flags)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if !c.check(ev) {
+			t.Errorf("%s: got %+v", c.name, ev)
+		}
+	}
+}
+
+// TestDecodeEventInvalidRecords decodes events whose info records do not
+// fit, which must fail with ErrInvalidData rather than read past them.
+func TestDecodeEventInvalidRecords(t *testing.T) {
+	fsid := [2]int32{7, 9}
+	handle := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	fid := func() []byte { return rawFID(unix.FAN_EVENT_INFO_TYPE_FID, fsid, 1, handle, "") }
+	for _, c := range []struct {
+		name   string
+		flags  uint
+		record []byte
+	}{
+		{"zero length", unix.FAN_REPORT_FID, withLen(fid(), 0)},
+		{"length past the event", unix.FAN_REPORT_FID, withLen(fid(), uint16(len(fid())+4))},
+		{"length far past the event", unix.FAN_REPORT_FID, withLen(fid(), 0xffff)},
+		{"record truncated before the handle", unix.FAN_REPORT_FID, withLen(fid()[:12], 12)},
+		{"handle past the record", unix.FAN_REPORT_FID, withLen(fid(), 20)},
+		{"pidfd record truncated", unix.FAN_REPORT_PIDFD, rawRecord(unix.FAN_EVENT_INFO_TYPE_PIDFD, nil)},
+		{"pidfd length past the event", unix.FAN_REPORT_PIDFD, withLen(rawPidfd(1000), 12)},
+		{"error record truncated", unix.FAN_REPORT_FID, withLen(rawError(5, 1)[:8], 8)},
+		{"no file identifier", unix.FAN_REPORT_FID, rawRecord(99, []byte{1, 2, 3, 4})},
+	} {
+		buf := rawEvent(unix.FAN_ATTRIB, unix.FAN_NOFD, 42, c.record)
+		if _, err := decodeEvent(buf, c.flags); !errors.Is(err, ErrInvalidData) {
+			t.Errorf("%s: got %v, want ErrInvalidData", c.name, err)
+		}
+	}
+}
+
+// TestGetInfoRecords walks records of several types in a row.
+func TestGetInfoRecords(t *testing.T) {
+	fsid := [2]int32{7, 9}
+	buf := bytes.Join([][]byte{
+		rawFID(unix.FAN_EVENT_INFO_TYPE_DFID, fsid, 1, []byte{1, 2, 3, 4}, ""),
+		rawPidfd(1000),
+		rawRecord(99, nil),
+		rawError(int32(unix.ENOSPC), 2),
+		rawFID(unix.FAN_EVENT_INFO_TYPE_DFID_NAME, fsid, 2, []byte{5, 6, 7, 8}, "a"),
+	}, nil)
+	info, err := getInfoRecords(buf, 0, len(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(info.fids) != 2 || info.fids[0].infoType != unix.FAN_EVENT_INFO_TYPE_DFID || info.fids[1].name != "a" ||
+		info.fids[1].handle.Type() != 2 || info.fids[0].fsid.val != fsid {
+		t.Errorf("records %+v", info.fids)
+	}
+	if info.pidfd != 1000 || info.pidfdError != nil {
+		t.Errorf("pidfd %d %v", info.pidfd, info.pidfdError)
+	}
+	if info.fsError == nil || info.fsError.Error != int32(unix.ENOSPC) || info.fsError.ErrorCount != 2 {
+		t.Errorf("error record %+v", info.fsError)
+	}
+	// the end bounds the walk, not the buffer
+	if _, err := getInfoRecords(buf, 0, len(buf)-1); !errors.Is(err, ErrInvalidData) {
+		t.Errorf("truncated: got %v, want ErrInvalidData", err)
+	}
+}
+
+func BenchmarkDecodeEvents(b *testing.B) {
+	var buf []byte
+	for i := 0; i < benchmarkBatch; i++ {
+		buf = append(buf, rawEvent(unix.FAN_CLOSE_WRITE, unix.FAN_NOFD, 42)...)
+	}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(buf)))
+	for i := 0; i < b.N; i++ {
+		if _, _, err := DecodeEvents(buf, 0); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkReadEvents measures the read path of a watcher in descriptor
+// mode, from the read of the event buffer to the resolved events, as the
+// read loop runs it for every wakeup.
+func BenchmarkReadEvents(b *testing.B) {
+	w, f := newFakeWatcher(b, b.TempDir(), WatchOptions{Mask: unix.FAN_CLOSE_WRITE, ManualRead: true})
+	fd, _ := openFd(b, "a")
+	defer unix.Close(int(fd))
+	var buf []byte
+	for i := 0; i < benchmarkBatch; i++ {
+		buf = append(buf, rawEvent(unix.FAN_CLOSE_WRITE, 0, 42)...)
+	}
+	var batch []Event
+	b.ReportAllocs()
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// every event owns its descriptor
+		for off := 0; off < len(buf); off += int(SizeOfFanotifyEventMetadata) {
+			dup, err := unix.Dup(int(fd))
+			if err != nil {
+				b.Fatal(err)
+			}
+			(*unix.FanotifyEventMetadata)(unsafe.Pointer(&buf[off])).Fd = int32(dup)
+		}
+		f.feed(b, buf)
+		var err error
+		batch, err = w.readEvents(batch[:0])
+		if err != nil || len(batch) != benchmarkBatch {
+			b.Fatalf("%d events: %v", len(batch), err)
+		}
+		for j := range batch {
+			batch[j].Close()
+		}
+	}
+	b.StopTimer()
+	reportAllocsPerEvent(b, &before)
+}
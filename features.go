@@ -0,0 +1,135 @@
+//go:build linux
+// +build linux
+
+package fanotify
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// Features reports which optional fanotify flags the running kernel
+// accepts, so callers can pick presets that will not fail in NewWatcher.
+type Features struct {
+	FID            bool // FAN_REPORT_FID, Linux 5.1
+	DFIDName       bool // FAN_REPORT_DFID_NAME, Linux 5.9
+	Pidfd          bool // FAN_REPORT_PIDFD, Linux 5.15
+	FilesystemMark bool // FAN_MARK_FILESYSTEM, Linux 4.20
+	EvictableMark  bool // FAN_MARK_EVICTABLE, Linux 5.19
+	IgnoreMark     bool // FAN_MARK_IGNORE, Linux 6.0
+	Rename         bool // FAN_RENAME, Linux 5.17
+}
+
+// Supported probes the running kernel with throwaway fanotify groups. The
+// probes never add marks, so they have no effect on the system. An error is
+// returned only if fanotify cannot be used at all, e.g. for lack of
+// CAP_SYS_ADMIN.
+func Supported() (Features, error) {
+	var f Features
+	fd, err := probeInit(unix.FAN_CLASS_NOTIF)
+	if err != nil {
+		return f, err
+	}
+	// removing a mark that does not exist fails with ENOENT once the
+	// mark flags have been accepted, and with EINVAL before that
+	f.FilesystemMark = probeMark(fd, unix.FAN_MARK_FILESYSTEM, unix.FAN_OPEN)
+	f.EvictableMark = probeMark(fd, FAN_MARK_EVICTABLE|unix.FAN_MARK_IGNORED_MASK, unix.FAN_OPEN)
+	f.IgnoreMark = probeMark(fd, FAN_MARK_IGNORE, unix.FAN_OPEN)
+	unix.Close(fd)
+
+	if fd, err = probeInit(unix.FAN_CLASS_NOTIF | unix.FAN_REPORT_FID); err == nil {
+		f.FID = true
+		unix.Close(fd)
+	}
+	if fd, err = probeInit(unix.FAN_CLASS_NOTIF | unix.FAN_REPORT_PIDFD); err == nil {
+		f.Pidfd = true
+		unix.Close(fd)
+	}
+	if fd, err = probeInit(unix.FAN_CLASS_NOTIF | unix.FAN_REPORT_DFID_NAME); err == nil {
+		f.DFIDName = true
+		f.Rename = probeMark(fd, 0, unix.FAN_RENAME)
+		unix.Close(fd)
+	}
+	return f, nil
+}
+
+// CheckPrivileges reports whether the process may create watchers, by
+// creating a throwaway fanotify group. Without CAP_SYS_ADMIN the returned
+// error wraps unix.EPERM, which lets callers such as integration tests
+// skip rather than fail:
+//
+//	if err := CheckPrivileges(); errors.Is(err, unix.EPERM) {
+//		t.Skip(err)
+//	}
+func CheckPrivileges() error {
+	fd, err := probeInit(unix.FAN_CLASS_NOTIF)
+	if errors.Is(err, unix.EPERM) {
+		return fmt.Errorf("fanotify requires CAP_SYS_ADMIN: %w", err)
+	}
+	if err != nil {
+		return err
+	}
+	return unix.Close(fd)
+}
+
+// checkProc returns an error wrapping ErrProcUnavailable unless the paths
+// of the events of a watcher initialized with flags can be resolved: the
+// descriptors of events are resolved through /proc/self/fd, and file
+// handles through a mount found in /proc/self/mountinfo.
+func checkProc(flags uint) error {
+	paths := []string{"/proc/self/fd"}
+	if flags&reportFIDFlags != 0 {
+		paths = append(paths, "/proc/self/mountinfo")
+	}
+	for _, path := range paths {
+		if err := unix.Access(path, unix.R_OK); err != nil {
+			return fmt.Errorf("%w: %v", ErrProcUnavailable, newSyscallError("Access", path, err))
+		}
+	}
+	return nil
+}
+
+// Validate reports whether NewWatcherWithOptions would succeed in watching
+// dir with opts on the running kernel, so that tools can reject a
+// configuration at startup. It initializes fanotify and marks dir like
+// NewWatcherWithOptions, then tears both down again without reading any
+// event. Flags and mark flags the kernel rejects are reported with the
+// kernel version they require, as determined by Supported.
+func Validate(dir string, opts WatchOptions) error {
+	w, err := newWatcher(dir, opts)
+	if err != nil {
+		return err
+	}
+	return w.release()
+}
+
+var (
+	featuresOnce sync.Once
+	features     Features
+)
+
+// supportedFeatures returns the result of Supported, probing the kernel
+// only once. Features the probe failed for are reported as unsupported.
+func supportedFeatures() Features {
+	featuresOnce.Do(func() {
+		features, _ = Supported()
+	})
+	return features
+}
+
+// probeInit creates a fanotify group with flags, returning a
+// *SyscallError if the kernel refuses them.
+func probeInit(flags uint) (int, error) {
+	fd, err := unix.FanotifyInit(flags|unix.FAN_CLOEXEC, DefaultFileStatusFlags)
+	return fd, newSyscallError("FanotifyInit", "", err)
+}
+
+// probeMark reports whether the kernel accepts markFlags and mask on the
+// group fd, without leaving a mark behind.
+func probeMark(fd int, markFlags uint, mask uint64) bool {
+	err := unix.FanotifyMark(fd, unix.FAN_MARK_REMOVE|markFlags, mask, unix.AT_FDCWD, "/")
+	return err == unix.ENOENT
+}
@@ -0,0 +1,35 @@
+//go:build linux
+// +build linux
+
+package fanotify
+
+import (
+	"testing"
+)
+
+// requirePrivileges skips the test unless the process may create fanotify
+// groups, which takes CAP_SYS_ADMIN, so that the tests using the kernel
+// pass when run unprivileged.
+func requirePrivileges(t testing.TB) {
+	t.Helper()
+	if err := CheckPrivileges(); err != nil {
+		t.Skipf("skipping test using fanotify: %v", err)
+	}
+}
+
+func TestSupported(t *testing.T) {
+	requirePrivileges(t)
+	f, err := Supported()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.DFIDName && !f.FID {
+		t.Errorf("%+v: FAN_REPORT_DFID_NAME without FAN_REPORT_FID", f)
+	}
+	if f.Rename && !f.DFIDName {
+		t.Errorf("%+v: FAN_RENAME without FAN_REPORT_DFID_NAME", f)
+	}
+	if supportedFeatures() != f {
+		t.Errorf("cached features %+v, probed %+v", supportedFeatures(), f)
+	}
+}
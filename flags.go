@@ -0,0 +1,180 @@
+package fanotify
+
+// InitFlagNames returns the names of the fanotify_init(2) flags set in
+// flags, the notification class first, e.g. "class-notif", "cloexec" and
+// "report-fid". It explains how a watcher was configured, see also
+// MaskValues.
+func InitFlagNames(flags uint) []string {
+	return initFlags(flags, true)
+}
+
+// InitFlagDescriptions returns the descriptions of the fanotify_init(2)
+// flags set in flags, the notification class first.
+func InitFlagDescriptions(flags uint) []string {
+	return initFlags(flags, false)
+}
+
+// MarkFlagNames returns the names of the fanotify_mark(2) flags set in
+// flags, the scope of the mark first, e.g. "inode", "add" and "onlydir".
+func MarkFlagNames(flags uint) []string {
+	return markFlags(flags, true)
+}
+
+// MarkFlagDescriptions returns the descriptions of the fanotify_mark(2)
+// flags set in flags, the scope of the mark first.
+func MarkFlagDescriptions(flags uint) []string {
+	return markFlags(flags, false)
+}
+
+// initFlags describes flags, the class being a field of two bits rather
+// than a bit of its own.
+func initFlags(flags uint, values bool) []string {
+	return describeField(flags, fanAllClassBits, classTable, initFlagTable, values)
+}
+
+// markFlags describes flags, the scope being a field of two bits rather
+// than a bit of its own.
+func markFlags(flags uint, values bool) []string {
+	return describeField(flags, markScopes, scopeTable, markFlagTable, values)
+}
+
+// describeField describes the value of the field selected by field in flags
+// as listed in fields, followed by the other bits of flags as listed in
+// table. An invalid field value is reported as unknown bits.
+func describeField(flags, field uint, fields map[uint]bitInfo, table map[int]bitInfo, values bool) []string {
+	v, ok := fields[flags&field]
+	if !ok {
+		return describeBits(uint64(flags), table, values)
+	}
+	ret := describeBits(uint64(flags&^field), table, values)
+	if values {
+		return append([]string{v.value}, ret...)
+	}
+	return append([]string{v.desc}, ret...)
+}
+
+// classTable maps each notification class to its name and description.
+var classTable = map[uint]bitInfo{
+	fanClassNotif: {
+		"class-notif",
+		"Receive events notifying that a file has been accessed; permission events are not allowed.",
+	},
+	fanClassContent: {
+		"class-content",
+		"Receive events and permission decisions once the content of a file is final.",
+	},
+	fanClassPreContent: {
+		"class-pre-content",
+		"Receive permission decisions before the content of a file is final, ahead of the other classes.",
+	},
+}
+
+// initFlagTable maps each fanotify_init flag bit other than the class to
+// its name and description.
+var initFlagTable = map[int]bitInfo{
+	fanCloexec: {
+		"cloexec",
+		"Set the close-on-exec flag on the fanotify descriptor.",
+	},
+	fanNonblock: {
+		"nonblock",
+		"Make reading the fanotify descriptor non-blocking.",
+	},
+	fanUnlimitedQueue: {
+		"unlimited-queue",
+		"Remove the limit of 16384 queued events.",
+	},
+	fanUnlimitedMarks: {
+		"unlimited-marks",
+		"Remove the limit of 8192 marks per user.",
+	},
+	fanEnableAudit: {
+		"enable-audit",
+		"Allow permission responses to request an audit record with FAN_AUDIT.",
+	},
+	fanReportPidfd: {
+		"report-pidfd",
+		"Report a pidfd for the process that caused each event (Linux 5.15).",
+	},
+	fanReportTID: {
+		"report-tid",
+		"Report the thread id rather than the process id (Linux 4.20).",
+	},
+	fanReportFID: {
+		"report-fid",
+		"Identify the object of events by file handle rather than by descriptor (Linux 5.1).",
+	},
+	fanReportDirFID: {
+		"report-dir-fid",
+		"Identify the directory of events by file handle (Linux 5.9).",
+	},
+	fanReportName: {
+		"report-name",
+		"Report the name of the directory entry events refer to (Linux 5.9).",
+	},
+	fanReportTargetFID: {
+		"report-target-fid",
+		"Also identify the child of directory entry events by file handle (Linux 5.17).",
+	},
+	FAN_REPORT_FD_ERROR: {
+		"report-fd-error",
+		"Report why the kernel failed to open the object of an event in place of its descriptor (Linux 6.13).",
+	},
+}
+
+// scopeTable maps each mark scope to its name and description.
+var scopeTable = map[uint]bitInfo{
+	fanMarkInode: {
+		"inode",
+		"Mark the inode the path refers to.",
+	},
+	fanMarkMount: {
+		"mount",
+		"Mark the mount containing the path.",
+	},
+	fanMarkFilesystem: {
+		"filesystem",
+		"Mark the filesystem containing the path (Linux 4.20).",
+	},
+}
+
+// markFlagTable maps each fanotify_mark flag bit other than the scope to
+// its name and description.
+var markFlagTable = map[int]bitInfo{
+	fanMarkAdd: {
+		"add",
+		"Add the events in mask to the mark.",
+	},
+	fanMarkRemove: {
+		"remove",
+		"Remove the events in mask from the mark.",
+	},
+	fanMarkDontFollow: {
+		"dont-follow",
+		"Mark a symbolic link itself rather than its target.",
+	},
+	fanMarkOnlyDir: {
+		"onlydir",
+		"Fail unless the path is a directory.",
+	},
+	fanMarkIgnoredMask: {
+		"ignored-mask",
+		"Change the ignore mask rather than the event mask.",
+	},
+	fanMarkIgnoredSurvModify: {
+		"ignored-surv-modify",
+		"Keep the ignore mask when the file is modified.",
+	},
+	fanMarkFlush: {
+		"flush",
+		"Remove every mark of the scope.",
+	},
+	FAN_MARK_EVICTABLE: {
+		"evictable",
+		"Let the kernel evict the marked inode from the cache along with the mark (Linux 5.19).",
+	},
+	FAN_MARK_IGNORE: {
+		"ignore",
+		"Change the ignore mask, honoring FAN_ONDIR and FAN_EVENT_ON_CHILD (Linux 6.0).",
+	},
+}
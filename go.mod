@@ -1,5 +1,5 @@
 module github.com/r00tu53r/fanotify
 
-go 1.17
+go 1.21
 
 require golang.org/x/sys v0.0.0-20220503163025-988cb79eb6c6
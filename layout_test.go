@@ -0,0 +1,97 @@
+//go:build linux
+// +build linux
+
+package fanotify
+
+import (
+	"encoding/binary"
+	"testing"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// kernelFileHandle and kernelEventInfoFID mirror struct file_handle and
+// struct fanotify_event_info_fid of the kernel headers, field by field, to
+// check the offsets the records are decoded with. Go lays out these fields
+// like C on every architecture Linux runs on.
+type kernelFileHandle struct {
+	handleBytes uint32
+	handleType  int32
+	fHandle     [0]byte
+}
+
+type kernelEventInfoFID struct {
+	infoType uint8
+	pad      uint8
+	length   uint16
+	fsid     [2]int32
+	handle   kernelFileHandle
+}
+
+// The same checks as TestLayout, failing to compile rather than to run, so
+// that building the tests for another architecture, e.g. with
+// GOARCH=arm64 go test -c, checks its layout without running there.
+var (
+	_ [unsafe.Offsetof(kernelEventInfoFID{}.fsid) - fidFSIDOffset]struct{}
+	_ [fidFSIDOffset - unsafe.Offsetof(kernelEventInfoFID{}.fsid)]struct{}
+	_ [unsafe.Offsetof(kernelEventInfoFID{}.handle) - fidHandleOffset]struct{}
+	_ [fidHandleOffset - unsafe.Offsetof(kernelEventInfoFID{}.handle)]struct{}
+	_ [unsafe.Offsetof(kernelFileHandle{}.fHandle) - handleDataOffset]struct{}
+	_ [handleDataOffset - unsafe.Offsetof(kernelFileHandle{}.fHandle)]struct{}
+	_ [unsafe.Sizeof(unix.FanotifyEventMetadata{}) - 24]struct{}
+	_ [24 - unsafe.Sizeof(unix.FanotifyEventMetadata{})]struct{}
+)
+
+func TestLayout(t *testing.T) {
+	var fid kernelEventInfoFID
+	var meta unix.FanotifyEventMetadata
+	for _, c := range []struct {
+		name      string
+		got, want uintptr
+	}{
+		{"fanotify_event_info_fid.fsid", unsafe.Offsetof(fid.fsid), fidFSIDOffset},
+		{"fanotify_event_info_fid.handle", unsafe.Offsetof(fid.handle), fidHandleOffset},
+		{"file_handle.handle_bytes", unsafe.Offsetof(fid.handle.handleBytes), handleSizeOffset},
+		{"file_handle.handle_type", unsafe.Offsetof(fid.handle.handleType), handleTypeOffset},
+		{"file_handle.f_handle", unsafe.Offsetof(fid.handle.fHandle), handleDataOffset},
+
+		{"fanotify_event_metadata", unsafe.Sizeof(meta), uintptr(SizeOfFanotifyEventMetadata)},
+		{"fanotify_event_metadata", unsafe.Sizeof(meta), 24},
+		{"fanotify_event_metadata.event_len", unsafe.Offsetof(meta.Event_len), 0},
+		{"fanotify_event_metadata.vers", unsafe.Offsetof(meta.Vers), 4},
+		{"fanotify_event_metadata.metadata_len", unsafe.Offsetof(meta.Metadata_len), 6},
+		{"fanotify_event_metadata.mask", unsafe.Offsetof(meta.Mask), 8},
+		{"fanotify_event_metadata.fd", unsafe.Offsetof(meta.Fd), 16},
+		{"fanotify_event_metadata.pid", unsafe.Offsetof(meta.Pid), 20},
+
+		{"fanotify_event_info_header", unsafe.Sizeof(FanotifyEventInfoHeader{}), 4},
+		{"fanotify_event_info_pidfd", unsafe.Sizeof(FanotifyEventInfoPidfd{}), pidfdRecordSize},
+		{"fanotify_event_info_error", unsafe.Sizeof(FanotifyEventInfoError{}), errorRecordSize},
+		{"fanotify_response", unsafe.Sizeof(unix.FanotifyResponse{}), 8},
+	} {
+		if c.got != c.want {
+			t.Errorf("%s: %d, want %d", c.name, c.got, c.want)
+		}
+	}
+}
+
+// TestDecodeFID decodes a FID record laid out by hand from the kernel
+// headers rather than from the offsets under test.
+func TestDecodeFID(t *testing.T) {
+	var body []byte
+	body = binary.NativeEndian.AppendUint32(body, 7) // fsid
+	body = binary.NativeEndian.AppendUint32(body, 9)
+	body = binary.NativeEndian.AppendUint32(body, 3) // handle_bytes
+	body = binary.NativeEndian.AppendUint32(body, 5) // handle_type
+	body = append(body, 0xa, 0xb, 0xc)               // f_handle
+	buf := rawEvent(unix.FAN_ATTRIB, unix.FAN_NOFD, 42, rawRecord(unix.FAN_EVENT_INFO_TYPE_FID, body))
+	events, _, err := DecodeEvents(buf, unix.FAN_REPORT_FID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev := events[0]
+	if ev.FSID.Val != [2]int32{7, 9} || ev.Handle == nil || ev.Handle.Type() != 5 || string(ev.Handle.Bytes()) != "\x0a\x0b\x0c" {
+		t.Errorf("fsid %v handle %v", ev.FSID, ev.Handle)
+	}
+}
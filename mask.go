@@ -0,0 +1,268 @@
+package fanotify
+
+import (
+	"fmt"
+	"strings"
+)
+
+// MaskBuilder composes an event mask one event at a time, as a readable
+// alternative to ORing FAN_* bits:
+//
+//	mask := fanotify.NewMask().Open().Modify().CloseWrite().OnChild().Build()
+//
+// Each method returns a new MaskBuilder, leaving the receiver unchanged, so
+// a common base can be extended in several ways. MaskFromStrings builds a
+// mask from the names of events instead.
+type MaskBuilder uint64
+
+// NewMask returns an empty MaskBuilder.
+func NewMask() MaskBuilder {
+	return 0
+}
+
+// Build returns the mask composed so far.
+func (b MaskBuilder) Build() uint64 {
+	return uint64(b)
+}
+
+// String returns the names of the events composed so far, see MaskValues.
+func (b MaskBuilder) String() string {
+	return strings.Join(MaskValues(uint64(b)), ",")
+}
+
+// Add adds the bits in mask, e.g. those of a preset.
+func (b MaskBuilder) Add(mask uint64) MaskBuilder {
+	return b | MaskBuilder(mask)
+}
+
+// Without removes the bits in mask.
+func (b MaskBuilder) Without(mask uint64) MaskBuilder {
+	return b &^ MaskBuilder(mask)
+}
+
+// Access adds FAN_ACCESS.
+func (b MaskBuilder) Access() MaskBuilder { return b.Add(fanAccess) }
+
+// Modify adds FAN_MODIFY.
+func (b MaskBuilder) Modify() MaskBuilder { return b.Add(fanModify) }
+
+// Attrib adds FAN_ATTRIB.
+func (b MaskBuilder) Attrib() MaskBuilder { return b.Add(fanAttrib) }
+
+// CloseWrite adds FAN_CLOSE_WRITE.
+func (b MaskBuilder) CloseWrite() MaskBuilder { return b.Add(fanCloseWrite) }
+
+// CloseNoWrite adds FAN_CLOSE_NOWRITE.
+func (b MaskBuilder) CloseNoWrite() MaskBuilder { return b.Add(fanCloseNoWrite) }
+
+// Close adds FAN_CLOSE, both FAN_CLOSE_WRITE and FAN_CLOSE_NOWRITE.
+func (b MaskBuilder) Close() MaskBuilder { return b.Add(fanClose) }
+
+// Open adds FAN_OPEN.
+func (b MaskBuilder) Open() MaskBuilder { return b.Add(fanOpen) }
+
+// OpenExec adds FAN_OPEN_EXEC.
+func (b MaskBuilder) OpenExec() MaskBuilder { return b.Add(fanOpenExec) }
+
+// Create adds FAN_CREATE.
+func (b MaskBuilder) Create() MaskBuilder { return b.Add(fanCreate) }
+
+// Delete adds FAN_DELETE.
+func (b MaskBuilder) Delete() MaskBuilder { return b.Add(fanDelete) }
+
+// DeleteSelf adds FAN_DELETE_SELF.
+func (b MaskBuilder) DeleteSelf() MaskBuilder { return b.Add(fanDeleteSelf) }
+
+// MovedFrom adds FAN_MOVED_FROM.
+func (b MaskBuilder) MovedFrom() MaskBuilder { return b.Add(fanMovedFrom) }
+
+// MovedTo adds FAN_MOVED_TO.
+func (b MaskBuilder) MovedTo() MaskBuilder { return b.Add(fanMovedTo) }
+
+// Move adds FAN_MOVE, both FAN_MOVED_FROM and FAN_MOVED_TO.
+func (b MaskBuilder) Move() MaskBuilder { return b.Add(fanMove) }
+
+// MoveSelf adds FAN_MOVE_SELF.
+func (b MaskBuilder) MoveSelf() MaskBuilder { return b.Add(fanMoveSelf) }
+
+// Rename adds FAN_RENAME (Linux 5.17).
+func (b MaskBuilder) Rename() MaskBuilder { return b.Add(fanRename) }
+
+// FSError adds FAN_FS_ERROR (Linux 5.16).
+func (b MaskBuilder) FSError() MaskBuilder { return b.Add(fanFSError) }
+
+// OpenPerm adds FAN_OPEN_PERM, a permission event.
+func (b MaskBuilder) OpenPerm() MaskBuilder { return b.Add(fanOpenPerm) }
+
+// AccessPerm adds FAN_ACCESS_PERM, a permission event.
+func (b MaskBuilder) AccessPerm() MaskBuilder { return b.Add(fanAccessPerm) }
+
+// OpenExecPerm adds FAN_OPEN_EXEC_PERM, a permission event.
+func (b MaskBuilder) OpenExecPerm() MaskBuilder { return b.Add(fanOpenExecPerm) }
+
+// OnDir adds FAN_ONDIR, so that the events are reported for directories
+// too.
+func (b MaskBuilder) OnDir() MaskBuilder { return b.Add(fanOnDir) }
+
+// OnChild adds FAN_EVENT_ON_CHILD, so that the events are reported for the
+// children of a marked directory, not only for the directory itself.
+func (b MaskBuilder) OnChild() MaskBuilder { return b.Add(fanEventOnChild) }
+
+// MaskValues returns the names of the bits set in m, ordered by bit value.
+func MaskValues(m uint64) []string {
+	return mask(m, true)
+}
+
+// MaskDescriptions returns the descriptions of the bits set in m, ordered by
+// bit value.
+func MaskDescriptions(m uint64) []string {
+	return mask(m, false)
+}
+
+// bitInfo is the name and description of a bit of a mask or of flags.
+type bitInfo struct {
+	value string
+	desc  string
+}
+
+// maskTable maps each event mask bit to its name and description.
+var maskTable = map[int]bitInfo{
+	fanAccess: {
+		"access",
+		"Create an event when a file or directory (but see BUGS) is accessed (read)",
+	},
+	fanModify: {
+		"modify",
+		"Create an event when a file is modified (write).",
+	},
+	fanOnDir: {
+		"ondir",
+		"Create events for directories, e.g. when readdir, opendir, closedir are called. In a reported event it flags that the subject is a directory.",
+	},
+	fanEventOnChild: {
+		"onchild",
+		"Events for the immediate children of marked directories shall be created",
+	},
+	fanCloseWrite: {
+		"close-write",
+		"Create an event when a writable file is closed.",
+	},
+	fanCloseNoWrite: {
+		"close-no-write",
+		"Create an event when a read-only file or directory is closed.",
+	},
+	fanOpen: {
+		"open",
+		"Create an event when a file or directory is opened.",
+	},
+	fanOpenExec: {
+		"exec",
+		"Create an event when a file is opened with the intent to be executed.",
+	},
+	fanAttrib: {
+		"attrib",
+		"Create an event when the metadata for a file or directory has changed.",
+	},
+	fanCreate: {
+		"create",
+		"Create an event when a file or directory has been created in a marked parent directory.",
+	},
+	fanDelete: {
+		"delete",
+		"Create an event when a file or directory has been deleted in a marked parent directory.",
+	},
+	fanDeleteSelf: {
+		"delete-self",
+		"Create an event when a marked file or directory itself is deleted.",
+	},
+	fanMovedFrom: {
+		"moved-from",
+		"Create an event when a file or directory has been moved from a marked parent directory.",
+	},
+	fanMovedTo: {
+		"moved-to",
+		"Create an event when a file or directory has been moved to a marked parent directory.",
+	},
+	fanMoveSelf: {
+		"move-self",
+		"Create an event when a marked file or directory itself has been moved.",
+	},
+	fanQOverflow: {
+		"q-overflow",
+		"Event queue overflowed; events were lost. Queued events are limited to 16384 unless FAN_UNLIMITED_QUEUE is passed to fanotify_init.",
+	},
+	fanOpenPerm: {
+		"open-perm",
+		"Create an event when a permission to open a file or directory is requested. A response is required.",
+	},
+	fanAccessPerm: {
+		"access-perm",
+		"Create an event when a permission to read a file or directory is requested. A response is required.",
+	},
+	fanOpenExecPerm: {
+		"exec-perm",
+		"Create an event when a permission to open a file for execution is requested. A response is required.",
+	},
+	fanRename: {
+		"rename",
+		"Create a single event carrying both the old and the new name when a file or directory is renamed (Linux 5.17).",
+	},
+	fanFSError: {
+		"fs-error",
+		"Create an event when a filesystem error is detected (Linux 5.16).",
+	},
+}
+
+// MaskFromStrings returns the mask with the bits named in names set, names
+// being the values returned by MaskValues such as "open" or "close-write".
+func MaskFromStrings(names []string) (uint64, error) {
+	var m uint64
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		found := false
+		for k, v := range maskTable {
+			if v.value == name {
+				m |= uint64(k)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("%w: %q", ErrUnknownEvent, name)
+		}
+	}
+	return m, nil
+}
+
+func mask(mask uint64, values bool) []string {
+	return describeBits(mask, maskTable, values)
+}
+
+// describeBits returns the names, or the descriptions unless values is set,
+// of the bits set in m as listed in table, ordered by bit value. Bits
+// missing from table are reported together as unknown.
+func describeBits(m uint64, table map[int]bitInfo, values bool) []string {
+	// walk the bits in ascending order rather than ranging over the
+	// table so that the result does not depend on map iteration order
+	var ret []string
+	var unknown uint64
+	for bit := uint64(1); bit != 0; bit <<= 1 {
+		if m&bit == 0 {
+			continue
+		}
+		v, ok := table[int(bit)]
+		if !ok {
+			unknown |= bit
+			continue
+		}
+		if values {
+			ret = append(ret, v.value)
+		} else {
+			ret = append(ret, v.desc)
+		}
+	}
+	if unknown != 0 {
+		ret = append(ret, fmt.Sprintf("unknown(%#x)", unknown))
+	}
+	return ret
+}
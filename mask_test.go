@@ -0,0 +1,44 @@
+package fanotify
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMaskValuesOrder(t *testing.T) {
+	m := uint64(fanOnDir | fanCreate | fanOpen | fanModify | fanAccess | fanCloseWrite | fanEventOnChild)
+	want := []string{"access", "modify", "close-write", "open", "create", "onchild", "ondir"}
+	// map iteration order differs from run to run, so a single call could
+	// return the sorted names by chance
+	for i := 0; i < 100; i++ {
+		if got := MaskValues(m); !reflect.DeepEqual(got, want) {
+			t.Fatalf("MaskValues(%#x) = %q, want %q", m, got, want)
+		}
+	}
+}
+
+func TestMaskDescriptionsOrder(t *testing.T) {
+	m := uint64(fanOpenPerm | fanDelete | fanAttrib)
+	want := []string{maskTable[fanAttrib].desc, maskTable[fanDelete].desc, maskTable[fanOpenPerm].desc}
+	for i := 0; i < 100; i++ {
+		if got := MaskDescriptions(m); !reflect.DeepEqual(got, want) {
+			t.Fatalf("MaskDescriptions(%#x) = %q, want %q", m, got, want)
+		}
+	}
+}
+
+func TestMaskValuesUnknown(t *testing.T) {
+	m := uint64(fanModify | 1<<40 | 1<<50)
+	want := []string{"modify", "unknown(0x4010000000000)"}
+	if got := MaskValues(m); !reflect.DeepEqual(got, want) {
+		t.Errorf("MaskValues(%#x) = %q, want %q", m, got, want)
+	}
+}
+
+func TestMaskFromStringsRoundTrip(t *testing.T) {
+	m := uint64(fanCloseWrite | fanMovedTo | fanRename | fanOnDir)
+	got, err := MaskFromStrings(MaskValues(m))
+	if err != nil || got != m {
+		t.Errorf("MaskFromStrings(MaskValues(%#x)) = %#x, %v", m, got, err)
+	}
+}
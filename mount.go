@@ -0,0 +1,267 @@
+//go:build linux
+// +build linux
+
+package fanotify
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// mountEntry is a line of /proc/self/mountinfo.
+type mountEntry struct {
+	id         int
+	dev        uint64 // device of the filesystem, see unix.Mkdev
+	root       string // root of the mount within its filesystem
+	mountPoint string
+	fsType     string
+	source     string
+}
+
+// readMountInfo returns the mounts listed in /proc/self/mountinfo.
+func readMountInfo() ([]mountEntry, error) {
+	mountInfo, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer mountInfo.Close()
+
+	var entries []mountEntry
+	scanner := bufio.NewScanner(mountInfo)
+	scanner.Split(bufio.ScanLines)
+	for scanner.Scan() {
+		entry, err := parseMountInfo(scanner.Text())
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, newSyscallError("read", "/proc/self/mountinfo", err)
+	}
+	return entries, nil
+}
+
+// parseMountInfo parses a line of /proc/self/mountinfo, see proc(5):
+//
+//	36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+//
+// The mount point is the fifth field. A variable number of optional fields
+// follows the mount options up to the "-" separator, after which come the
+// filesystem type and the mount source. Whitespace and backslashes within
+// fields are escaped as octal sequences such as \040.
+func parseMountInfo(line string) (mountEntry, error) {
+	toks := strings.Fields(line)
+	sep := -1
+	for i := 6; i < len(toks); i++ {
+		if toks[i] == "-" {
+			sep = i
+			break
+		}
+	}
+	if sep < 0 || len(toks) < sep+3 {
+		return mountEntry{}, fmt.Errorf("%w: mountinfo line %q", ErrInvalidData, line)
+	}
+	id, err := strconv.Atoi(toks[0])
+	if err != nil {
+		return mountEntry{}, fmt.Errorf("%w: mountinfo line %q", ErrInvalidData, line)
+	}
+	dev, err := parseDev(toks[2])
+	if err != nil {
+		return mountEntry{}, fmt.Errorf("%w: mountinfo line %q", ErrInvalidData, line)
+	}
+	return mountEntry{
+		id:         id,
+		dev:        dev,
+		root:       unescapeMountField(toks[3]),
+		mountPoint: unescapeMountField(toks[4]),
+		fsType:     unescapeMountField(toks[sep+1]),
+		source:     unescapeMountField(toks[sep+2]),
+	}, nil
+}
+
+// parseDev parses the major:minor device number of a mountinfo line.
+func parseDev(s string) (uint64, error) {
+	i := strings.IndexByte(s, ':')
+	if i < 0 {
+		return 0, strconv.ErrSyntax
+	}
+	major, err := strconv.ParseUint(s[:i], 10, 32)
+	if err != nil {
+		return 0, err
+	}
+	minor, err := strconv.ParseUint(s[i+1:], 10, 32)
+	if err != nil {
+		return 0, err
+	}
+	return unix.Mkdev(uint32(major), uint32(minor)), nil
+}
+
+// unescapeMountField replaces the \ooo octal escapes the kernel uses for
+// space, tab, newline and backslash in mountinfo fields.
+func unescapeMountField(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// fsidOf returns the filesystem id of the filesystem path belongs to, the
+// same id the kernel reports in FID info records.
+func fsidOf(path string) (kernelFSID, error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(path, &st); err != nil {
+		return kernelFSID{}, newSyscallError("Statfs", path, err)
+	}
+	return kernelFSID{val: st.Fsid.Val}, nil
+}
+
+// markedObject returns the path of the object marked at path. Unless follow
+// is set that is a symlink itself, which is stored on the filesystem of its
+// directory rather than on that of its target.
+func markedObject(path string, follow bool) string {
+	if !follow {
+		var st unix.Stat_t
+		if err := unix.Lstat(path, &st); err == nil && st.Mode&unix.S_IFMT == unix.S_IFLNK {
+			return filepath.Dir(path)
+		}
+	}
+	return path
+}
+
+// markedFSID returns the filesystem id of the object marked at path, see
+// markedObject.
+func markedFSID(path string, follow bool) (kernelFSID, error) {
+	return fsidOf(markedObject(path, follow))
+}
+
+// addMount opens a mount of the filesystem containing the object marked at
+// path ahead of the first event, caching it under the id of the
+// filesystem. follow tells whether the mark followed a symlink at path.
+// The device of the object is kept to narrow the mounts mountFd checks.
+func (w *Watcher) addMount(path string, follow bool) error {
+	path = markedObject(path, follow)
+	fsid, err := fsidOf(path)
+	if err != nil {
+		return err
+	}
+	var st unix.Stat_t
+	if err := unix.Stat(path, &st); err == nil {
+		w.mountsMu.Lock()
+		w.mountDevs[fsid] = st.Dev
+		w.mountsMu.Unlock()
+	}
+	_, err = w.mountFd(fsid)
+	return err
+}
+
+// openMount is a mount point opened by mountFd.
+type openMount struct {
+	fd    int
+	entry mountEntry
+}
+
+// mountOf returns the mount through which the handles of the filesystem
+// identified by fsid are opened, if mountFd opened one.
+func (w *Watcher) mountOf(fsid kernelFSID) (mountEntry, bool) {
+	w.mountsMu.Lock()
+	defer w.mountsMu.Unlock()
+	m, ok := w.mountFds[fsid]
+	return m.entry, ok
+}
+
+// mountFd returns an open mount point of the filesystem identified by fsid.
+// Unknown filesystems are looked up in /proc/self/mountinfo with
+// matchMount, the mount id reported by name_to_handle_at(2) does not
+// identify a filesystem. statfs(2) of a mount point may block, e.g. on a
+// network filesystem whose server is gone, so mountsMu is not held during
+// the lookup. A failed lookup is remembered until the mounts change, and
+// the returned error wraps ErrMountNotFound.
+func (w *Watcher) mountFd(fsid kernelFSID) (int, error) {
+	w.mountsMu.Lock()
+	m, ok := w.mountFds[fsid]
+	dev := w.mountDevs[fsid]
+	missed := w.mountMisses[fsid]
+	w.mountsMu.Unlock()
+	if ok {
+		return m.fd, nil
+	}
+	entries, err := readMountInfo()
+	if err != nil {
+		return -1, err
+	}
+	notFound := fmt.Errorf("%w for fsid %v among %d mounts", ErrMountNotFound, fsid.val, len(entries))
+	if missed != nil && slices.Equal(missed, entries) {
+		return -1, notFound
+	}
+	match := matchMount(entries, fsid, dev, fsidOf)
+	if match == nil {
+		w.mountsMu.Lock()
+		w.mountMisses[fsid] = entries
+		w.mountsMu.Unlock()
+		return -1, notFound
+	}
+	fd, err := unix.Open(match.mountPoint, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, newSyscallError("Open", match.mountPoint, err)
+	}
+	w.mountsMu.Lock()
+	defer w.mountsMu.Unlock()
+	if m, ok := w.mountFds[fsid]; ok {
+		// opened by a concurrent lookup
+		unix.Close(fd)
+		return m.fd, nil
+	}
+	delete(w.mountMisses, fsid)
+	w.mountFds[fsid] = openMount{fd: fd, entry: *match}
+	return fd, nil
+}
+
+// matchMount returns the entry mounting the filesystem identified by fsid,
+// comparing the id statfs returns for each mount point. Only the mounts of
+// device dev, if known, are checked first, the others only if none of them
+// matches. Automount points are skipped as checking them mounts them. Mounts
+// of the root of the filesystem are preferred over bind mounts of a
+// subtree, which cannot resolve handles of objects outside of it to a path.
+func matchMount(entries []mountEntry, fsid kernelFSID, dev uint64, statfs func(string) (kernelFSID, error)) *mountEntry {
+	find := func(candidate func(mountEntry) bool) *mountEntry {
+		var match *mountEntry
+		for i, entry := range entries {
+			if entry.fsType == "autofs" || !candidate(entry) {
+				continue
+			}
+			if match != nil && (match.root == "/" || entry.root != "/") {
+				continue
+			}
+			if got, err := statfs(entry.mountPoint); err != nil || got != fsid {
+				continue
+			}
+			match = &entries[i]
+		}
+		return match
+	}
+	if match := find(func(e mountEntry) bool { return e.dev == dev }); match != nil {
+		return match
+	}
+	// the files of btrfs subvolumes or of overlayfs report another device
+	// than their mount
+	return find(func(e mountEntry) bool { return e.dev != dev })
+}
@@ -0,0 +1,176 @@
+//go:build linux
+// +build linux
+
+package fanotify
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestParseMountInfo(t *testing.T) {
+	for _, c := range []struct {
+		line string
+		want mountEntry
+	}{
+		{
+			"36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue",
+			mountEntry{id: 36, dev: unix.Mkdev(98, 0), root: "/mnt1", mountPoint: "/mnt2", fsType: "ext3", source: "/dev/root"},
+		},
+		{
+			// no optional fields
+			"22 1 8:1 / / rw,relatime - ext4 /dev/sda1 rw",
+			mountEntry{id: 22, dev: unix.Mkdev(8, 1), root: "/", mountPoint: "/", fsType: "ext4", source: "/dev/sda1"},
+		},
+		{
+			// several optional fields
+			"40 22 0:35 / /run/user rw shared:5 master:2 propagate_from:1 unbindable - tmpfs tmpfs rw",
+			mountEntry{id: 40, dev: unix.Mkdev(0, 35), root: "/", mountPoint: "/run/user", fsType: "tmpfs", source: "tmpfs"},
+		},
+		{
+			// escaped space, tab, newline and backslash
+			`41 22 259:3 /a\040b /mnt/my\040disk\011x\012y rw - vfat /dev/back\134slash rw`,
+			mountEntry{id: 41, dev: unix.Mkdev(259, 3), root: "/a b", mountPoint: "/mnt/my disk\tx\ny", fsType: "vfat", source: `/dev/back\slash`},
+		},
+		{
+			// a mount point named like the separator
+			"42 22 0:40 / - rw shared:7 - tmpfs none rw",
+			mountEntry{id: 42, dev: unix.Mkdev(0, 40), root: "/", mountPoint: "-", fsType: "tmpfs", source: "none"},
+		},
+		{
+			// an escape ending the field
+			`43 22 0:41 / /mnt/trailing\040 rw - tmpfs none rw`,
+			mountEntry{id: 43, dev: unix.Mkdev(0, 41), root: "/", mountPoint: "/mnt/trailing ", fsType: "tmpfs", source: "none"},
+		},
+	} {
+		got, err := parseMountInfo(c.line)
+		if err != nil {
+			t.Errorf("%q: %v", c.line, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("%q:\ngot  %+v\nwant %+v", c.line, got, c.want)
+		}
+	}
+}
+
+func TestParseMountInfoInvalid(t *testing.T) {
+	for _, line := range []string{
+		"",
+		// no separator
+		"36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 ext3 /dev/root rw",
+		// nothing after the separator
+		"36 35 98:0 /mnt1 /mnt2 rw,noatime -",
+		"36 35 98:0 /mnt1 /mnt2 rw,noatime - ext3",
+		// bad id and device
+		"x 35 98:0 /mnt1 /mnt2 rw - ext3 /dev/root rw",
+		"36 35 98 /mnt1 /mnt2 rw - ext3 /dev/root rw",
+		"36 35 98:y /mnt1 /mnt2 rw - ext3 /dev/root rw",
+	} {
+		if _, err := parseMountInfo(line); !errors.Is(err, ErrInvalidData) {
+			t.Errorf("%q: got %v, want ErrInvalidData", line, err)
+		}
+	}
+}
+
+func TestUnescapeMountField(t *testing.T) {
+	for _, c := range []struct{ in, want string }{
+		{"/plain", "/plain"},
+		{`/a\040b`, "/a b"},
+		{`\040`, " "},
+		{`/a\134b`, `/a\b`},
+		{`/a\134040`, `/a\040`},
+		{`/a\011\012`, "/a\t\n"},
+		// not escapes: too short, not octal or out of range
+		{`/a\04`, `/a\04`},
+		{`/a\`, `/a\`},
+		{`/a\089`, `/a\089`},
+		{`/a\777`, `/a\777`},
+	} {
+		if got := unescapeMountField(c.in); got != c.want {
+			t.Errorf("unescapeMountField(%q) = %q, want %q", c.in, got, c.want)
+		}
+	}
+}
+
+func TestReadMountInfo(t *testing.T) {
+	entries, err := readMountInfo()
+	if err != nil {
+		t.Skip(err)
+	}
+	for _, e := range entries {
+		if e.mountPoint == "/" {
+			return
+		}
+	}
+	t.Errorf("no root mount in %+v", entries)
+}
+
+func TestMatchMount(t *testing.T) {
+	fsid := kernelFSID{val: [2]int32{1, 2}}
+	other := kernelFSID{val: [2]int32{3, 4}}
+	entries := []mountEntry{
+		{id: 1, dev: unix.Mkdev(8, 1), root: "/", mountPoint: "/", fsType: "ext4"},
+		{id: 2, dev: unix.Mkdev(8, 2), root: "/sub", mountPoint: "/bind", fsType: "ext4"},
+		{id: 3, dev: unix.Mkdev(0, 40), root: "/", mountPoint: "/net", fsType: "autofs"},
+		{id: 4, dev: unix.Mkdev(0, 41), root: "/", mountPoint: "/dead", fsType: "nfs"},
+		{id: 5, dev: unix.Mkdev(8, 2), root: "/", mountPoint: "/data", fsType: "ext4"},
+		{id: 6, dev: unix.Mkdev(0, 50), root: "/", mountPoint: "/subvol", fsType: "btrfs"},
+	}
+	fsids := map[string]kernelFSID{"/": other, "/bind": fsid, "/data": fsid, "/subvol": fsid}
+	for _, c := range []struct {
+		name    string
+		dev     uint64
+		want    int
+		statted []string
+	}{
+		{"by device", unix.Mkdev(8, 2), 5, []string{"/bind", "/data"}},
+		{"device not mounted", unix.Mkdev(0, 99), 5, []string{"/", "/bind", "/dead", "/data"}},
+		{"unknown device", 0, 5, []string{"/", "/bind", "/dead", "/data"}},
+	} {
+		var statted []string
+		got := matchMount(entries, fsid, c.dev, func(path string) (kernelFSID, error) {
+			statted = append(statted, path)
+			if id, ok := fsids[path]; ok {
+				return id, nil
+			}
+			return kernelFSID{}, unix.ESTALE
+		})
+		if got == nil || got.id != c.want {
+			t.Errorf("%s: got %+v, want mount %d", c.name, got, c.want)
+		}
+		if !slices.Equal(statted, c.statted) {
+			t.Errorf("%s: statted %q, want %q", c.name, statted, c.statted)
+		}
+	}
+}
+
+func TestMountFdMiss(t *testing.T) {
+	w, _ := newFakeWatcher(t, t.TempDir(), WatchOptions{Flags: unix.FAN_REPORT_FID, Mask: unix.FAN_CREATE})
+	fsid := kernelFSID{val: [2]int32{-1, -1}}
+	missed := func() []mountEntry {
+		if _, err := w.mountFd(fsid); !errors.Is(err, ErrMountNotFound) {
+			t.Fatalf("got %v, want ErrMountNotFound", err)
+		}
+		w.mountsMu.Lock()
+		defer w.mountsMu.Unlock()
+		return w.mountMisses[fsid]
+	}
+	first := missed()
+	if len(first) == 0 {
+		t.Fatal("miss not cached")
+	}
+	// the cached miss answers as long as the mounts are the same
+	if again := missed(); &again[0] != &first[0] {
+		t.Error("mounts checked again although unchanged")
+	}
+	w.mountsMu.Lock()
+	first[0].fsType = "changed"
+	w.mountsMu.Unlock()
+	if again := missed(); &again[0] == &first[0] {
+		t.Error("mounts not checked again once changed")
+	}
+}
@@ -0,0 +1,144 @@
+package fanotify
+
+// FileAccessedOrModified raises event when
+// (1) "file" is created or modified under the monitored directory.
+// The metadata.Fd is the file descriptor to the file created/modified.
+// (2) "file" is read
+func FileAccessedOrModified() (uint, uint64) {
+	flags := uint(fanClassNotif | fanCloexec)
+	mask := uint64(fanAccess | fanModify | fanEventOnChild)
+	return flags, mask
+}
+
+// FileCloseWriteNoWrite raises event when
+// (1) "file" is accessed / read and closed then "close-no-write" is
+// raised.
+// (2) "file" is written or updated and closed then "close-write" is
+// raised.
+// NOTE multiple close-no-writes are raised for files opened by editors,
+// these can be suppressed with Watcher.AddIgnoreMark
+func FileCloseWriteNoWrite() (uint, uint64) {
+	flags := uint(fanClassNotif | fanCloexec)
+	mask := uint64(fanCloseWrite | fanCloseNoWrite | fanEventOnChild)
+	return flags, mask
+}
+
+// FileOpenExec raises event when
+// (1) if "file" is opened raises FAN_OPEN
+// (2) if "file" is executed raises FAN_OPEN and FAN_OPEN_EXEC
+func FileOpenExec() (uint, uint64) {
+	flags := uint(fanClassNotif | fanCloexec)
+	mask := uint64(fanOpen | fanOpenExec | fanEventOnChild)
+	return flags, mask
+}
+
+// FileAttribChange raises event when file's attribute is changed
+// NOTE does not detect changes to extended attributes
+func FileAttribChange() (uint, uint64) {
+	flags := uint(fanClassNotif | fanCloexec | fanReportFID)
+	mask := uint64(fanAttrib | fanEventOnChild)
+	return flags, mask
+}
+
+// FileOrDirCreated raises event when "file" or "directory" is created under
+// the monitored directory. The FileHandle only has information about the
+// parent path and not the child that was created. Initializing with
+// FAN_REPORT_DFID_NAME instead of FAN_REPORT_FID makes the kernel report the
+// child's name as well, see Event.Name.
+//
+// NOTE (Caveat) the subdirectory created is not returned. Hence it is not
+// possible to selectively monitor subdirectories. The only
+// option is to use FAN_MARK_MOUNT or FAN_MARK_FILESYSTEM and then selectively
+// ignore
+func FileOrDirCreated() (uint, uint64) {
+	flags := uint(fanClassNotif | fanCloexec | fanReportFID)
+	mask := uint64(fanCreate | fanEventOnChild | fanOnDir)
+	return flags, mask
+}
+
+// FileOrDirEntryChanged raises event when "file" or "directory" is created,
+// deleted or renamed under the monitored directory. Unlike FileOrDirCreated
+// the events carry the parent directory and the name of the entry
+// (FAN_EVENT_INFO_TYPE_DFID_NAME), reported as Event.Name. A rename is
+// reported as a moved-from event with the old name followed by a moved-to
+// event with the new name, for directories as well as files.
+//
+// NOTE FAN_REPORT_DFID_NAME requires Linux 5.9 or later
+func FileOrDirEntryChanged() (uint, uint64) {
+	flags := uint(fanClassNotif | fanCloexec | fanReportDFIDName)
+	mask := uint64(fanCreate | fanDelete | fanMove | fanEventOnChild | fanOnDir)
+	return flags, mask
+}
+
+// FileRenamed raises a single FAN_RENAME event when "file" or "directory"
+// under the monitored directory is renamed, reported as Event.Rename with
+// both the old and the new directory entry.
+//
+// NOTE FAN_RENAME requires Linux 5.17 or later. On older kernels the preset
+// falls back to FAN_MOVED_FROM and FAN_MOVED_TO, reported as two events as
+// with FileOrDirEntryChanged. The kernel is probed once, see Supported; if
+// it cannot be probed, e.g. without CAP_SYS_ADMIN, the fallback is returned
+// as well.
+func FileRenamed() (uint, uint64) {
+	flags := uint(fanClassNotif | fanCloexec | fanReportDFIDName)
+	mask := uint64(fanRename | fanEventOnChild | fanOnDir)
+	if !supportedFeatures().Rename {
+		mask = fanMove | fanEventOnChild | fanOnDir
+	}
+	return flags, mask
+}
+
+// FileDeleteSelf raises event when
+// (1) file or directory under the marked directory is deleted.
+// (2) the marked directory itself is deleted
+//
+// NOTE (Caveat) when the marked directory is deleted its file handle
+// becomes stale, the event reports the marked path as Event.MarkPath and
+// sets Event.MarkRemoved as the kernel drops the mark
+func FileDeleteSelf() (uint, uint64) {
+	flags := uint(fanClassNotif | fanCloexec | fanReportFID)
+	mask := uint64(fanDelete | fanDeleteSelf | fanOnDir)
+	return flags, mask
+}
+
+// FilePermission raises permission events when
+// (1) "file" is opened raises FAN_OPEN_PERM
+// (2) "file" is read raises FAN_ACCESS_PERM
+//
+// NOTE every event must be answered with Watcher.Respond, otherwise the
+// process accessing the file blocks
+func FilePermission() (uint, uint64) {
+	flags := uint(fanClassContent | fanCloexec)
+	mask := uint64(fanOpenPerm | fanAccessPerm | fanEventOnChild)
+	return flags, mask
+}
+
+// FileExecPermission raises a FAN_OPEN_EXEC_PERM permission event when a
+// "file" is opened for execution, letting the watcher allow or deny running
+// it. Used with FAN_MARK_MOUNT or FAN_MARK_FILESYSTEM it gates every
+// program started from that mount or filesystem.
+//
+// NOTE every event must be answered with Watcher.Respond: until then the
+// exec blocks, and a stalled watcher blocks every exec it covers, system
+// wide for a filesystem mark on /
+func FileExecPermission() (uint, uint64) {
+	flags := uint(fanClassContent | fanCloexec)
+	mask := uint64(fanOpenExecPerm | fanEventOnChild)
+	return flags, mask
+}
+
+// FilePreContent raises the permission events of FilePermission in the
+// FAN_CLASS_PRE_CONTENT class, which the kernel delivers ahead of the
+// FAN_CLASS_CONTENT and FAN_CLASS_NOTIF groups watching the same files. A
+// hierarchical storage manager uses it to fill in the content of a file
+// before any other watcher or the accessing process sees it.
+//
+// NOTE every event must be answered with Watcher.Respond: the accessing
+// process blocks until then, indefinitely if the watcher stalls. Like the
+// other permission classes it requires CAP_SYS_ADMIN and a kernel built
+// with CONFIG_FANOTIFY_ACCESS_PERMISSIONS
+func FilePreContent() (uint, uint64) {
+	flags := uint(fanClassPreContent | fanCloexec)
+	mask := uint64(fanOpenPerm | fanAccessPerm | fanEventOnChild)
+	return flags, mask
+}
@@ -0,0 +1,171 @@
+//go:build linux
+// +build linux
+
+package fanotify
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Reinit replaces the fanotify descriptor of w with a new one, initialized
+// with the flags w was created with, and adds the marks listed by Marks to
+// it again. It lets a long-lived watcher recover once its descriptor is no
+// longer usable, e.g. after the read loop stopped with an error.
+//
+// The events queued on the old descriptor are lost, so the first event
+// delivered afterwards is an Overflow event, the cue to rescan the watched
+// files. Permission events delivered before and still awaiting Respond are
+// allowed before the old descriptor is closed; Respond then only closes
+// their Fd and returns an error wrapping ErrReinitialized. If the read loop
+// had stopped, Reinit starts a new one on new Events and Errors channels
+// and clears Err.
+//
+// Marks that cannot be added again, e.g. as their path was removed, are
+// forgotten and reported in the returned error, the others stay in effect.
+// Marks added with AddMarkFd are added again by the path their descriptor
+// referred to. Reinit must not be called concurrently with the methods of w
+// that use its descriptor, such as AddMark or Respond. It returns ErrClosed
+// once w is closed.
+func (w *Watcher) Reinit() error {
+	w.lifeMu.Lock()
+	defer w.lifeMu.Unlock()
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return ErrClosed
+	}
+	w.restarting = true
+	w.mu.Unlock()
+
+	stopped := w.manualRead
+	if !w.manualRead {
+		select {
+		case <-w.done:
+			stopped = true
+		default:
+			close(w.closing)
+		}
+	}
+	if err := w.wake(); err != nil {
+		w.mu.Lock()
+		w.restarting = false
+		w.mu.Unlock()
+		return err
+	}
+	<-w.done
+
+	w.readMu.Lock()
+	var buf [8]byte
+	unix.Read(w.wakeFd, buf[:])
+	if w.tree != nil {
+		// new directories are marked by another goroutine
+		w.tree.markMu.Lock()
+	}
+	err := w.reopen()
+	if w.tree != nil {
+		w.tree.markMu.Unlock()
+	}
+	w.readMu.Unlock()
+	if err != nil {
+		w.reportError(fmt.Errorf("reinitializing: %w", err))
+	}
+
+	if w.manualRead {
+		w.mu.Lock()
+		w.restarting = false
+		w.mu.Unlock()
+		return err
+	}
+	w.mu.Lock()
+	w.closing = make(chan struct{})
+	w.done = make(chan struct{})
+	if stopped {
+		w.events = make(chan Event, eventsBufferSize)
+		w.errs = make(chan error, errorsBufferSize)
+		w.errsClosed = false
+		w.err = nil
+	}
+	w.restarting = false
+	w.mu.Unlock()
+	go w.run()
+	return err
+}
+
+// reopen replaces fd and adds the tracked marks to the new descriptor. fd
+// is left in place if no new descriptor can be initialized.
+func (w *Watcher) reopen() error {
+	fd, err := w.sys.FanotifyInit(w.initFlags, w.fileStatusFlags)
+	if err != nil {
+		return initError(w.initFlags, err)
+	}
+	ev := unix.EpollEvent{Events: unix.EPOLLIN, Fd: int32(fd)}
+	if err := unix.EpollCtl(w.epollFd, unix.EPOLL_CTL_ADD, fd, &ev); err != nil {
+		unix.Close(fd)
+		return newSyscallError("EpollCtl", "", err)
+	}
+	// closing the old descriptor removes it from epoll
+	w.allowPending()
+	unix.Close(w.fd)
+	w.fd = fd
+	w.partial = 0
+	w.lost = true
+	atomic.AddUint64(&w.stats.overflows, 1)
+	return w.remark()
+}
+
+// remark adds the tracked marks to fd, forgetting those that fail.
+func (w *Watcher) remark() error {
+	marks := w.Marks()
+	var failed int
+	var first error
+	for _, m := range marks {
+		err := w.addTracked(m)
+		if err == nil {
+			continue
+		}
+		w.recordMark(m.Path, m.Scope, func(m *Mark) { m.Mask, m.IgnoredMask = 0, 0 })
+		if failed++; first == nil {
+			first = err
+		}
+	}
+	if first != nil {
+		return fmt.Errorf("%d of %d marks not added again: %w", failed, len(marks), first)
+	}
+	return nil
+}
+
+// addTracked adds the masks of m to fd.
+func (w *Watcher) addTracked(m Mark) error {
+	if m.Mask != 0 {
+		flags := unix.FAN_MARK_ADD | m.Scope | m.flags
+		if err := w.sys.FanotifyMark(w.fd, flags, m.Mask, -1, m.Path); err != nil {
+			return markError(flags, m.Path, err)
+		}
+	}
+	if m.IgnoredMask != 0 {
+		flags := unix.FAN_MARK_ADD | m.Scope | m.ignoreFlags
+		if err := w.sys.FanotifyMark(w.fd, flags, m.IgnoredMask, -1, m.Path); err != nil {
+			return markError(flags, m.Path, err)
+		}
+	}
+	return nil
+}
+
+// lostEvent returns the Overflow event reporting the events dropped by
+// Reinit.
+func (w *Watcher) lostEvent() Event {
+	w.seq++
+	return Event{
+		Seq:      w.seq,
+		Time:     time.Now(),
+		Mask:     unix.FAN_Q_OVERFLOW,
+		Values:   MaskValues(unix.FAN_Q_OVERFLOW),
+		Overflow: true,
+		Fd:       unix.FAN_NOFD,
+		PidFd:    unix.FAN_NOPIDFD,
+	}
+}
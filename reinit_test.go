@@ -0,0 +1,144 @@
+//go:build linux
+// +build linux
+
+package fanotify
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// TestFakeReinit checks that Reinit replaces the descriptor, marks the
+// tracked paths on the new one and reports the lost events first.
+func TestFakeReinit(t *testing.T) {
+	dir, other := t.TempDir(), t.TempDir()
+	w, f := newFakeWatcher(t, dir, WatchOptions{Mask: unix.FAN_OPEN})
+	if err := w.AddMark(other, unix.FAN_CLOSE_WRITE); err != nil {
+		t.Fatal(err)
+	}
+	old := f.r
+	if err := w.Reinit(); err != nil {
+		t.Fatal(err)
+	}
+	if f.r == old {
+		t.Fatal("descriptor not replaced")
+	}
+	if _, err := unix.FcntlInt(uintptr(old), unix.F_GETFD, 0); err != unix.EBADF {
+		t.Errorf("old descriptor not closed: %v", err)
+	}
+	f.mu.Lock()
+	want := []fakeMark{
+		{flags: unix.FAN_MARK_ADD, mask: unix.FAN_OPEN, path: dir},
+		{flags: unix.FAN_MARK_ADD, mask: unix.FAN_CLOSE_WRITE, path: other},
+	}
+	if len(f.marks) != 4 || !sameMarks(f.marks[2:], want) {
+		t.Errorf("marks %+v, want %+v marked again", f.marks, want)
+	}
+	f.mu.Unlock()
+
+	ev := receive(t, w)
+	if !ev.Overflow || ev.Mask != unix.FAN_Q_OVERFLOW || ev.Seq != 1 {
+		t.Errorf("first event %+v, want an overflow", ev)
+	}
+	if s := w.Stats(); s.Overflows != 1 {
+		t.Errorf("%d overflows", s.Overflows)
+	}
+	fd, path := openFd(t, "a")
+	f.feed(t, rawEvent(unix.FAN_OPEN, fd, 42))
+	ev = receive(t, w)
+	defer ev.Close()
+	if ev.Path != path || ev.Seq != 2 {
+		t.Errorf("got %v seq %d, want %v seq 2", ev.Path, ev.Seq, path)
+	}
+}
+
+// sameMarks reports whether got holds the marks of want in any order.
+func sameMarks(got, want []fakeMark) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for _, m := range want {
+		found := false
+		for _, g := range got {
+			found = found || g == m
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// TestFakeReinitMarkError fails to mark the tracked paths again, which
+// Reinit reports, forgetting the marks.
+func TestFakeReinitMarkError(t *testing.T) {
+	w, f := newFakeWatcher(t, t.TempDir(), WatchOptions{Mask: unix.FAN_OPEN})
+	if err := w.AddMark(t.TempDir(), 0); err != nil {
+		t.Fatal(err)
+	}
+	f.mu.Lock()
+	f.markErr = unix.ENOENT
+	f.mu.Unlock()
+	err := w.Reinit()
+	if !errors.Is(err, ErrPathNotFound) || !strings.Contains(err.Error(), "2 of 2 marks") {
+		t.Fatalf("Reinit: %v", err)
+	}
+	select {
+	case rerr := <-w.Errors():
+		if !errors.Is(rerr, ErrPathNotFound) || !strings.Contains(rerr.Error(), "reinitializing") {
+			t.Errorf("reported %v", rerr)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("error not reported")
+	}
+	if marks := w.Marks(); len(marks) != 0 {
+		t.Errorf("marks %+v kept", marks)
+	}
+	if ev := receive(t, w); !ev.Overflow {
+		t.Errorf("first event %+v, want an overflow", ev)
+	}
+}
+
+// TestFakeReinitPending reinitializes the watcher while a permission event
+// awaits its response: Reinit allows it on the old descriptor before
+// closing it, with or without a response timeout, and Respond only
+// releases its fd.
+func TestFakeReinitPending(t *testing.T) {
+	for _, timeout := range []time.Duration{0, 10 * time.Millisecond} {
+		w, f := newFakeWatcher(t, t.TempDir(), WatchOptions{Mask: unix.FAN_OPEN_PERM, ResponseTimeout: timeout})
+		fd, _ := openFd(t, "a")
+		f.feed(t, rawEvent(unix.FAN_OPEN_PERM, fd, 42))
+		ev := receive(t, w)
+		old := f.r
+		if err := w.Reinit(); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(2 * timeout)
+		f.mu.Lock()
+		want := unix.FanotifyResponse{Fd: fd, Response: unix.FAN_ALLOW}
+		if len(f.responses) != 1 || f.responses[0] != want || f.responded[0] != old {
+			t.Errorf("timeout %v: responses %+v to %v, want %+v to %d", timeout, f.responses, f.responded, want, old)
+		}
+		f.mu.Unlock()
+		if err := w.Respond(ev.Fd, false); !errors.Is(err, ErrReinitialized) {
+			t.Errorf("timeout %v: Respond: got %v, want ErrReinitialized", timeout, err)
+		}
+		if _, err := unix.FcntlInt(uintptr(fd), unix.F_GETFD, 0); err != unix.EBADF {
+			t.Errorf("timeout %v: event fd not released: %v", timeout, err)
+		}
+		f.mu.Lock()
+		if len(f.responses) != 1 {
+			t.Errorf("timeout %v: responses %+v, want only the one of Reinit", timeout, f.responses)
+		}
+		f.mu.Unlock()
+		select {
+		case err := <-w.Errors():
+			t.Errorf("timeout %v: error %v", timeout, err)
+		default:
+		}
+	}
+}
@@ -0,0 +1,50 @@
+//go:build linux
+// +build linux
+
+package fanotify
+
+import "sync/atomic"
+
+// Stats counts what a Watcher has seen since it was created, for callers to
+// export to their monitoring. A growing Overflows count means the read loop
+// or the consumer of Events does not keep up with the event volume.
+type Stats struct {
+	// Events is the number of events delivered on the Events channel or
+	// returned by ReadBatch, including overflow events. Events rejected
+	// by WatchOptions.Filter are not counted.
+	Events uint64
+	// Overflows is the number of FAN_Q_OVERFLOW events, each reporting
+	// that the kernel dropped events because its queue was full.
+	Overflows uint64
+	// ResolveErrors is the number of events whose path could not be
+	// resolved, whether they were dropped or delivered without a path,
+	// mostly as OpenByHandleAt failed to open a file handle of an object
+	// deleted before the event was read. Each event is counted once.
+	// Delete and moved-from events, whose object is expected to be gone
+	// and whose path is taken from the parent directory instead, are not
+	// counted.
+	ResolveErrors uint64
+	// DecodeErrors is the number of malformed events read.
+	DecodeErrors uint64
+}
+
+// watcherStats holds the counters of Stats, updated atomically by the read
+// loop. It is the first field of Watcher to keep the counters 64-bit
+// aligned on 32-bit platforms.
+type watcherStats struct {
+	events        uint64
+	overflows     uint64
+	resolveErrors uint64
+	decodeErrors  uint64
+}
+
+// Stats returns a snapshot of the counters of w. It is safe to call
+// concurrently with the read loop, also after Close.
+func (w *Watcher) Stats() Stats {
+	return Stats{
+		Events:        atomic.LoadUint64(&w.stats.events),
+		Overflows:     atomic.LoadUint64(&w.stats.overflows),
+		ResolveErrors: atomic.LoadUint64(&w.stats.resolveErrors),
+		DecodeErrors:  atomic.LoadUint64(&w.stats.decodeErrors),
+	}
+}
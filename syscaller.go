@@ -0,0 +1,48 @@
+//go:build linux
+// +build linux
+
+package fanotify
+
+import "golang.org/x/sys/unix"
+
+// syscaller performs the system calls of a Watcher that the kernel answers
+// with events, so that the decoding and resolution of events can be
+// exercised without privileges by a fake feeding crafted event buffers,
+// set per watcher through WatchOptions.sys. The descriptor returned by
+// FanotifyInit must be one epoll can wait on, such as the read end of a
+// pipe the fake writes to as it queues buffers.
+type syscaller interface {
+	FanotifyInit(flags, eventFileFlags uint) (int, error)
+	FanotifyMark(fd int, flags uint, mask uint64, dirfd int, path string) error
+	Read(fd int, p []byte) (int, error)
+	Write(fd int, p []byte) (int, error)
+	EpollWait(epfd int, events []unix.EpollEvent, msec int) (int, error)
+	Eventfd(initval uint, flags int) (int, error)
+}
+
+// unixSyscaller makes the system calls through golang.org/x/sys/unix.
+type unixSyscaller struct{}
+
+func (unixSyscaller) FanotifyInit(flags, eventFileFlags uint) (int, error) {
+	return unix.FanotifyInit(flags, eventFileFlags)
+}
+
+func (unixSyscaller) FanotifyMark(fd int, flags uint, mask uint64, dirfd int, path string) error {
+	return unix.FanotifyMark(fd, flags, mask, dirfd, path)
+}
+
+func (unixSyscaller) Read(fd int, p []byte) (int, error) {
+	return unix.Read(fd, p)
+}
+
+func (unixSyscaller) Write(fd int, p []byte) (int, error) {
+	return unix.Write(fd, p)
+}
+
+func (unixSyscaller) EpollWait(epfd int, events []unix.EpollEvent, msec int) (int, error) {
+	return unix.EpollWait(epfd, events, msec)
+}
+
+func (unixSyscaller) Eventfd(initval uint, flags int) (int, error) {
+	return unix.Eventfd(initval, flags)
+}
@@ -0,0 +1,415 @@
+//go:build linux
+// +build linux
+
+package fanotify
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// fakeSyscaller stands in for the kernel, feeding the watcher the event
+// buffers queued with feed. Its fanotify descriptor is the read end of a
+// pipe holding a byte per queued buffer, so that epoll reports it readable
+// while buffers are left.
+type fakeSyscaller struct {
+	mu        sync.Mutex
+	r, w      int      // pipe, r is the fanotify descriptor
+	reads     [][]byte // results of the next reads
+	markErr   error    // returned by FanotifyMark
+	marks     []fakeMark
+	responses []unix.FanotifyResponse
+	responded []int // fanotify descriptor each response was written to
+	fanFds    []int // descriptors returned by FanotifyInit
+	split     bool  // Read returns what fits of a buffer rather than EINVAL
+	eintr     int   // EpollWait calls still to fail with EINTR
+	waits     int   // EpollWait calls made
+	waiter    int   // thread id of the last EpollWait call
+	signaled  int   // EpollWait calls interrupted by a real signal
+}
+
+// fakeMark records a call of FanotifyMark.
+type fakeMark struct {
+	flags uint
+	mask  uint64
+	path  string
+}
+
+func (f *fakeSyscaller) FanotifyInit(flags, eventFileFlags uint) (int, error) {
+	var p [2]int
+	if err := unix.Pipe2(p[:], unix.O_CLOEXEC|unix.O_NONBLOCK); err != nil {
+		return -1, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.r, f.w = p[0], p[1]
+	f.fanFds = append(f.fanFds, f.r)
+	return f.r, nil
+}
+
+func (f *fakeSyscaller) FanotifyMark(fd int, flags uint, mask uint64, dirfd int, path string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.markErr != nil {
+		return f.markErr
+	}
+	f.marks = append(f.marks, fakeMark{flags: flags, mask: mask, path: path})
+	return nil
+}
+
+// Read returns the next queued buffer, failing with EINVAL like the kernel
+// if it does not fit in p, and with EAGAIN if none is left. With split set
+// it returns what fits instead, leaving the rest for the next read.
+func (f *fakeSyscaller) Read(fd int, p []byte) (int, error) {
+	if fd != f.r {
+		return unix.Read(fd, p)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.reads) == 0 {
+		return 0, unix.EAGAIN
+	}
+	if len(f.reads[0]) > len(p) {
+		if !f.split {
+			return 0, unix.EINVAL
+		}
+		n := copy(p, f.reads[0])
+		f.reads[0] = f.reads[0][n:]
+		return n, nil
+	}
+	var b [1]byte
+	unix.Read(f.r, b[:])
+	n := copy(p, f.reads[0])
+	f.reads = f.reads[1:]
+	return n, nil
+}
+
+// Write records the responses written to any of the fanotify descriptors,
+// which must still be open.
+func (f *fakeSyscaller) Write(fd int, p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !slices.Contains(f.fanFds, fd) {
+		return unix.Write(fd, p)
+	}
+	if _, err := unix.FcntlInt(uintptr(fd), unix.F_GETFD, 0); err != nil {
+		return 0, err
+	}
+	f.responses = append(f.responses, *(*unix.FanotifyResponse)(unsafe.Pointer(&p[0])))
+	f.responded = append(f.responded, fd)
+	return len(p), nil
+}
+
+func (f *fakeSyscaller) EpollWait(epfd int, events []unix.EpollEvent, msec int) (int, error) {
+	f.mu.Lock()
+	f.waits++
+	if f.eintr > 0 {
+		f.eintr--
+		f.mu.Unlock()
+		return 0, unix.EINTR
+	}
+	f.waiter = unix.Gettid()
+	f.mu.Unlock()
+	n, err := unix.EpollWait(epfd, events, msec)
+	if err == unix.EINTR {
+		f.mu.Lock()
+		f.signaled++
+		f.mu.Unlock()
+	}
+	return n, err
+}
+
+func (f *fakeSyscaller) Eventfd(initval uint, flags int) (int, error) {
+	return unix.Eventfd(initval, flags)
+}
+
+// feed queues bufs, each returned by a read of its own.
+func (f *fakeSyscaller) feed(t testing.TB, bufs ...[]byte) {
+	t.Helper()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, buf := range bufs {
+		f.reads = append(f.reads, buf)
+		if _, err := unix.Write(f.w, []byte{0}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// newFakeWatcher returns a watcher of dir reading its events from a fake,
+// closed along with the fake when the test ends.
+func newFakeWatcher(t testing.TB, dir string, opts WatchOptions) (*Watcher, *fakeSyscaller) {
+	t.Helper()
+	f := &fakeSyscaller{r: -1, w: -1}
+	opts.sys = f
+	w, err := NewWatcherWithOptions(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		w.Close()
+		unix.Close(f.w)
+	})
+	return w, f
+}
+
+// rawEvent returns an event as the kernel reports it, the metadata followed
+// by the info records.
+func rawEvent(mask uint64, fd, pid int32, records ...[]byte) []byte {
+	n := int(SizeOfFanotifyEventMetadata)
+	for _, rec := range records {
+		n += len(rec)
+	}
+	buf := make([]byte, n)
+	m := (*unix.FanotifyEventMetadata)(unsafe.Pointer(&buf[0]))
+	m.Event_len = uint32(n)
+	m.Vers = unix.FANOTIFY_METADATA_VERSION
+	m.Metadata_len = uint16(SizeOfFanotifyEventMetadata)
+	m.Mask = mask
+	m.Fd = fd
+	m.Pid = pid
+	off := int(SizeOfFanotifyEventMetadata)
+	for _, rec := range records {
+		off += copy(buf[off:], rec)
+	}
+	return buf
+}
+
+// rawRecord returns an info record of infoType holding body, padded to a
+// multiple of 4 bytes like the kernel does.
+func rawRecord(infoType uint8, body []byte) []byte {
+	n := (4 + len(body) + 3) &^ 3
+	rec := make([]byte, n)
+	rec[0] = infoType
+	binary.NativeEndian.PutUint16(rec[2:], uint16(n))
+	copy(rec[4:], body)
+	return rec
+}
+
+// rawFID returns a file identifier record of infoType, with name appended
+// for the DFID_NAME types.
+func rawFID(infoType uint8, fsid [2]int32, handleType int32, handle []byte, name string) []byte {
+	body := make([]byte, 16, 16+len(handle)+len(name)+1)
+	binary.NativeEndian.PutUint32(body[0:], uint32(fsid[0]))
+	binary.NativeEndian.PutUint32(body[4:], uint32(fsid[1]))
+	binary.NativeEndian.PutUint32(body[8:], uint32(len(handle)))
+	binary.NativeEndian.PutUint32(body[12:], uint32(handleType))
+	body = append(body, handle...)
+	if name != "" {
+		body = append(append(body, name...), 0)
+	}
+	return rawRecord(infoType, body)
+}
+
+// rawPidfd returns a pidfd record.
+func rawPidfd(pidfd int32) []byte {
+	var body [4]byte
+	binary.NativeEndian.PutUint32(body[:], uint32(pidfd))
+	return rawRecord(unix.FAN_EVENT_INFO_TYPE_PIDFD, body[:])
+}
+
+// rawError returns a filesystem error record.
+func rawError(errno int32, count uint32) []byte {
+	var body [8]byte
+	binary.NativeEndian.PutUint32(body[0:], uint32(errno))
+	binary.NativeEndian.PutUint32(body[4:], count)
+	return rawRecord(unix.FAN_EVENT_INFO_TYPE_ERROR, body[:])
+}
+
+// openFd returns a descriptor of a new file in a temporary directory, to be
+// reported as the descriptor of an event, along with the path of the file.
+// The watcher owns the descriptor once the event is fed.
+func openFd(t testing.TB, name string) (int32, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	fd, err := unix.Open(path, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return int32(fd), path
+}
+
+// receive returns the next event of w, failing the test if none arrives.
+func receive(t testing.TB, w *Watcher) Event {
+	t.Helper()
+	select {
+	case ev, ok := <-w.Events():
+		if !ok {
+			t.Fatalf("events closed: %v", w.Err())
+		}
+		return ev
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event")
+	}
+	return Event{}
+}
+
+func TestFakeReadEvents(t *testing.T) {
+	dir := t.TempDir()
+	w, f := newFakeWatcher(t, dir, WatchOptions{Mask: unix.FAN_OPEN | unix.FAN_CLOSE_WRITE})
+	f.mu.Lock()
+	if len(f.marks) != 1 || f.marks[0].path != dir || f.marks[0].flags != unix.FAN_MARK_ADD {
+		t.Errorf("marks %+v, want %v marked", f.marks, dir)
+	}
+	f.mu.Unlock()
+	fd1, path1 := openFd(t, "a")
+	fd2, path2 := openFd(t, "b")
+	// two events in a single read, then one in a read of its own
+	f.feed(t, append(rawEvent(unix.FAN_OPEN, fd1, 42), rawEvent(unix.FAN_CLOSE_WRITE, fd2, 43)...))
+	fd3, path3 := openFd(t, "c")
+	f.feed(t, rawEvent(unix.FAN_OPEN, fd3, 44))
+
+	for i, want := range []struct {
+		path string
+		mask uint64
+		pid  int32
+	}{
+		{path1, unix.FAN_OPEN, 42},
+		{path2, unix.FAN_CLOSE_WRITE, 43},
+		{path3, unix.FAN_OPEN, 44},
+	} {
+		ev := receive(t, w)
+		if ev.Path != want.path || ev.Mask != want.mask || ev.Pid != want.pid {
+			t.Errorf("event %d: got %v %#x pid %d, want %v %#x pid %d", i, ev.Path, ev.Mask, ev.Pid, want.path, want.mask, want.pid)
+		}
+		if ev.Seq != uint64(i+1) {
+			t.Errorf("event %d: Seq %d", i, ev.Seq)
+		}
+		ev.Close()
+	}
+	if s := w.Stats(); s.Events != 3 || s.DecodeErrors != 0 {
+		t.Errorf("stats %+v", s)
+	}
+}
+
+func TestFakeRespond(t *testing.T) {
+	w, f := newFakeWatcher(t, t.TempDir(), WatchOptions{Mask: unix.FAN_OPEN_PERM})
+	fd, _ := openFd(t, "a")
+	f.feed(t, rawEvent(unix.FAN_OPEN_PERM, fd, 42))
+	ev := receive(t, w)
+	if !ev.ResponseRequired {
+		t.Fatal("permission event without ResponseRequired")
+	}
+	if err := w.Respond(ev.Fd, false); err != nil {
+		t.Fatal(err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	want := []unix.FanotifyResponse{{Fd: fd, Response: unix.FAN_DENY}}
+	if len(f.responses) != 1 || f.responses[0] != want[0] {
+		t.Errorf("responses %+v, want %+v", f.responses, want)
+	}
+}
+
+// TestFakeResponseTimeout lets a permission event time out, which answers
+// it with the default response and leaves its fd for Respond to release.
+func TestFakeResponseTimeout(t *testing.T) {
+	w, f := newFakeWatcher(t, t.TempDir(), WatchOptions{
+		Mask:            unix.FAN_OPEN_PERM,
+		ResponseTimeout: 10 * time.Millisecond,
+		AllowOnTimeout:  true,
+	})
+	fd, _ := openFd(t, "a")
+	f.feed(t, rawEvent(unix.FAN_OPEN_PERM, fd, 42))
+	ev := receive(t, w)
+	want := unix.FanotifyResponse{Fd: fd, Response: unix.FAN_ALLOW}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		f.mu.Lock()
+		responses := append([]unix.FanotifyResponse(nil), f.responses...)
+		f.mu.Unlock()
+		if len(responses) == 1 && responses[0] == want {
+			break
+		}
+		if len(responses) > 0 || time.Now().After(deadline) {
+			t.Fatalf("responses %+v, want %+v", responses, want)
+		}
+	}
+	if _, err := unix.FcntlInt(uintptr(fd), unix.F_GETFD, 0); err != nil {
+		t.Fatalf("event fd closed before Respond: %v", err)
+	}
+	if err := w.Respond(ev.Fd, false); !errors.Is(err, ErrResponseTimeout) {
+		t.Errorf("Respond: got %v, want ErrResponseTimeout", err)
+	}
+	if _, err := unix.FcntlInt(uintptr(fd), unix.F_GETFD, 0); err != unix.EBADF {
+		t.Errorf("event fd not released: %v", err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.responses) != 1 {
+		t.Errorf("responses %+v, want only the default one", f.responses)
+	}
+}
+
+// TestFakeCloseWakeError breaks the wakeup descriptor, which Close reports
+// after releasing the descriptors all the same.
+func TestFakeCloseWakeError(t *testing.T) {
+	w, f := newFakeWatcher(t, t.TempDir(), WatchOptions{Mask: unix.FAN_OPEN, ManualRead: true})
+	var p [2]int
+	if err := unix.Pipe2(p[:], unix.O_CLOEXEC); err != nil {
+		t.Fatal(err)
+	}
+	unix.Close(p[1])
+	// writing to the read end of a pipe fails with EBADF
+	unix.Close(w.wakeFd)
+	w.wakeFd = p[0]
+	if err := w.Close(); !errors.Is(err, unix.EBADF) {
+		t.Errorf("Close: got %v, want EBADF", err)
+	}
+	for _, fd := range []int{f.r, p[0]} {
+		if _, err := unix.FcntlInt(uintptr(fd), unix.F_GETFD, 0); err != unix.EBADF {
+			t.Errorf("descriptor %d left open: %v", fd, err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+}
+
+func TestFakeMarkError(t *testing.T) {
+	w, f := newFakeWatcher(t, t.TempDir(), WatchOptions{Mask: unix.FAN_OPEN})
+	f.mu.Lock()
+	f.markErr = unix.ENOSPC
+	f.mu.Unlock()
+	err := w.AddMark("/tmp", 0)
+	var serr *SyscallError
+	if !errors.Is(err, ErrMarkLimit) || !errors.Is(err, unix.ENOSPC) || !errors.As(err, &serr) || serr.Path != "/tmp" {
+		t.Errorf("AddMark: %v", err)
+	}
+}
+
+func TestFakeMalformedEvent(t *testing.T) {
+	w, f := newFakeWatcher(t, t.TempDir(), WatchOptions{Mask: unix.FAN_OPEN})
+	// an event with a pidfd record too short to hold a pidfd is skipped,
+	// the event after it is still delivered
+	bad := rawEvent(unix.FAN_OPEN, unix.FAN_NOFD, 42, rawRecord(unix.FAN_EVENT_INFO_TYPE_PIDFD, nil))
+	fd, path := openFd(t, "a")
+	f.feed(t, append(bad, rawEvent(unix.FAN_OPEN, fd, 43)...))
+	ev := receive(t, w)
+	defer ev.Close()
+	if ev.Path != path || ev.Pid != 43 {
+		t.Errorf("got %v pid %d, want %v pid 43", ev.Path, ev.Pid, path)
+	}
+	select {
+	case err := <-w.Errors():
+		if !errors.Is(err, ErrInvalidData) {
+			t.Errorf("error %v, want ErrInvalidData", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("malformed event not reported")
+	}
+	if s := w.Stats(); s.DecodeErrors != 1 {
+		t.Errorf("DecodeErrors %d, want 1", s.DecodeErrors)
+	}
+}
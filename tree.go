@@ -0,0 +1,199 @@
+//go:build linux
+// +build linux
+
+package fanotify
+
+import (
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// treeEvents are the events a tree watcher needs to follow directories
+// appearing in the tree, in addition to those requested.
+const treeEvents = unix.FAN_CREATE | unix.FAN_MOVED_TO | unix.FAN_ONDIR | unix.FAN_EVENT_ON_CHILD
+
+// tree is the state of a watcher created by WatchTree.
+type tree struct {
+	root string // absolute path without symlinks
+	mask uint64 // events requested by the caller
+
+	// queue holds the new directories left to mark, marking is set while
+	// a goroutine marks them, see markLater
+	mu      sync.Mutex
+	queue   []string
+	marking bool
+
+	// markMu is held while a directory is marked, so that Close and Reinit
+	// do not replace the fanotify descriptor meanwhile
+	markMu  sync.Mutex
+	stopped bool // set by Close
+}
+
+// WatchTree watches root and every directory below it for the events in
+// mask, emulating a recursive inotify watch. Inode marks only cover the
+// marked directory and its direct children, so the tree is walked to mark
+// each directory, and directories later created or moved into the tree are
+// marked as their events are read, walking each of them in turn to catch
+// subdirectories created before the mark. New directories are marked
+// apart from the read loop, the events of their entries are only reported
+// once the mark is in place. Only events in mask are delivered.
+//
+// The kernel drops the marks of deleted directories by itself. Marks lists
+// the directories renamed within the tree under their new path, and no
+// longer lists those moved out of the tree, which are unmarked once they
+// report their next event, not delivered. Before Linux 5.17, which lacks
+// FAN_RENAME, Marks keeps listing moved directories under their old path.
+//
+// NOTE the names of new directories are taken from FAN_REPORT_DFID_NAME
+// records, which require Linux 5.9 or later.
+func WatchTree(root string, mask uint64) (*Watcher, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	// paths of events are resolved without symlinks
+	if root, err = filepath.EvalSymlinks(root); err != nil {
+		return nil, err
+	}
+	events := mask | treeEvents
+	if supportedFeatures().Rename {
+		events |= unix.FAN_RENAME
+	}
+	w, err := newWatcher(root, WatchOptions{
+		Flags: unix.FAN_CLASS_NOTIF | unix.FAN_CLOEXEC | unix.FAN_REPORT_DFID_NAME,
+		Mask:  events,
+	})
+	if err != nil {
+		return nil, err
+	}
+	w.tree = &tree{root: root, mask: mask &^ (unix.FAN_ONDIR | unix.FAN_EVENT_ON_CHILD)}
+	if err := w.markTree(root); err != nil {
+		w.release()
+		return nil, err
+	}
+	go w.run()
+	return w, nil
+}
+
+// contains reports whether path is root or below it.
+func (t *tree) contains(path string) bool {
+	return path == t.root || strings.HasPrefix(path, t.root+"/")
+}
+
+// stop keeps the marking goroutine from adding further marks, once the
+// mark in progress is added.
+func (t *tree) stop() {
+	t.markMu.Lock()
+	defer t.markMu.Unlock()
+	t.stopped = true
+}
+
+// markTree marks every directory below dir. Entries vanishing during the
+// walk are skipped, as is the rest of the walk once the watcher is closed.
+func (w *Watcher) markTree(dir string) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			return nil
+		case err != nil:
+			return err
+		case !d.IsDir() || path == w.tree.root:
+			return nil
+		}
+		w.tree.markMu.Lock()
+		defer w.tree.markMu.Unlock()
+		if w.tree.stopped {
+			return fs.SkipAll
+		}
+		// the directory may have been replaced by a file meanwhile
+		err = w.AddMarkFlags(path, unix.FAN_MARK_ONLYDIR, 0)
+		if err != nil && !errors.Is(err, unix.ENOENT) && !errors.Is(err, unix.ENOTDIR) {
+			return err
+		}
+		return nil
+	})
+}
+
+// markLater queues the new directory dir to be marked by markQueued, so
+// that walking it does not hold up the read loop.
+func (w *Watcher) markLater(dir string) {
+	t := w.tree
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.queue = append(t.queue, dir)
+	if !t.marking {
+		t.marking = true
+		go w.markQueued()
+	}
+}
+
+// markQueued marks the directories queued by markLater until none is left.
+func (w *Watcher) markQueued() {
+	t := w.tree
+	for {
+		t.mu.Lock()
+		if len(t.queue) == 0 {
+			t.marking = false
+			t.mu.Unlock()
+			return
+		}
+		dir := t.queue[0]
+		t.queue = t.queue[1:]
+		t.mu.Unlock()
+		if err := w.markTree(dir); err != nil {
+			w.reportError(err)
+		}
+	}
+}
+
+// followTree updates the marks of a tree watcher for ev and reports whether
+// ev was requested by the caller.
+func (w *Watcher) followTree(ev Event) bool {
+	if ev.Path == "" {
+		return ev.Mask&w.tree.mask != 0
+	}
+	if ev.Rename != nil && ev.IsDir {
+		w.followRename(ev.Rename)
+		return ev.Mask&w.tree.mask != 0
+	}
+	// directory entry events are reported for the marked parent
+	dir := ev.Path
+	if ev.Name != "" {
+		dir = filepath.Dir(ev.Path)
+	}
+	if !w.tree.contains(dir) {
+		// moved out of the tree, its mark is already forgotten if
+		// FAN_RENAME reported the move
+		w.RemoveMark(dir, 0)
+		return false
+	}
+	if ev.IsDir && ev.Mask&(unix.FAN_CREATE|unix.FAN_MOVED_TO) != 0 {
+		w.markLater(ev.Path)
+	}
+	return ev.Mask&w.tree.mask != 0
+}
+
+// followRename tracks the marks of a directory renamed within the tree and
+// of those below it under their new paths, the paths Marks lists and
+// Reinit marks again. The kernel reports the entry of a directory that is
+// not marked without its directory and name, so r lacks the new entry of a
+// directory moved out of the tree: its marks are forgotten, and removed
+// from the kernel by followTree once it reports an event.
+func (w *Watcher) followRename(r *RenameEvent) {
+	if r.OldDir == "" {
+		// moved into the tree, marked for its FAN_MOVED_TO event
+		return
+	}
+	old := filepath.Join(r.OldDir, r.OldName)
+	switch {
+	case r.NewName == "":
+		w.moveMarks(old, "")
+	case r.NewDir != "":
+		w.moveMarks(old, filepath.Join(r.NewDir, r.NewName))
+	}
+}
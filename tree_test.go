@@ -0,0 +1,117 @@
+//go:build linux
+// +build linux
+
+package fanotify
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// waitMarks waits until the marks of w under prefix are exactly want.
+func waitMarks(t testing.TB, w *Watcher, prefix string, want ...string) {
+	t.Helper()
+	var got []string
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		got = got[:0]
+		for _, m := range w.Marks() {
+			if m.Path == prefix || strings.HasPrefix(m.Path, prefix+"/") {
+				got = append(got, m.Path)
+			}
+		}
+		if strings.Join(got, "\n") == strings.Join(want, "\n") {
+			return
+		}
+	}
+	t.Fatalf("marks under %s: got %q, want %q", prefix, got, want)
+}
+
+// TestWatchTree creates a directory in the tree, moves one in, renames it
+// and moves another out, and checks that the events of the entries below
+// the directories in the tree are delivered, and only those.
+func TestWatchTree(t *testing.T) {
+	requirePrivileges(t)
+	root, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	outside, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(root, "old", "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	w, err := WatchTree(root, unix.FAN_CREATE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	create := func(path string) {
+		t.Helper()
+		if err := os.WriteFile(path, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, w, func(ev Event) bool {
+			defer ev.Close()
+			return ev.Path == path
+		})
+	}
+	waitMarks(t, w, filepath.Join(root, "old"), filepath.Join(root, "old"), filepath.Join(root, "old", "sub"))
+
+	// created in the tree
+	if err := os.Mkdir(filepath.Join(root, "new"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	waitMarks(t, w, filepath.Join(root, "new"), filepath.Join(root, "new"))
+	create(filepath.Join(root, "new", "f"))
+
+	// moved into the tree along with its subdirectory
+	if err := os.MkdirAll(filepath.Join(outside, "in", "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(outside, "in"), filepath.Join(root, "in")); err != nil {
+		t.Fatal(err)
+	}
+	waitMarks(t, w, filepath.Join(root, "in"), filepath.Join(root, "in"), filepath.Join(root, "in", "sub"))
+	create(filepath.Join(root, "in", "sub", "f"))
+
+	if !supportedFeatures().Rename {
+		t.Skip("renames are only followed with FAN_RENAME")
+	}
+	// renamed within the tree
+	renamed := filepath.Join(root, "renamed")
+	if err := os.Rename(filepath.Join(root, "in"), renamed); err != nil {
+		t.Fatal(err)
+	}
+	waitMarks(t, w, renamed, renamed, filepath.Join(renamed, "sub"))
+	waitMarks(t, w, filepath.Join(root, "in"))
+	create(filepath.Join(renamed, "sub", "g"))
+
+	// moved out of the tree
+	out := filepath.Join(outside, "out")
+	if err := os.Rename(filepath.Join(root, "old"), out); err != nil {
+		t.Fatal(err)
+	}
+	waitMarks(t, w, filepath.Join(root, "old"))
+	waitMarks(t, w, out)
+	if err := os.WriteFile(filepath.Join(out, "sub", "f"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	last := filepath.Join(root, "last")
+	if err := os.WriteFile(last, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, w, func(ev Event) bool {
+		defer ev.Close()
+		if !strings.HasPrefix(ev.Path, root+"/") {
+			t.Errorf("event %v outside the tree", ev.Path)
+		}
+		return ev.Path == last
+	})
+}
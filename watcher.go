@@ -0,0 +1,1478 @@
+//go:build linux
+// +build linux
+
+package fanotify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Watcher holds the fanotify file descriptor along with the mount file
+// descriptors used to resolve file handles reported with FAN_REPORT_FID.
+type Watcher struct {
+	stats       watcherStats // see Stats
+	sys         syscaller
+	fd          int
+	mountsMu    sync.Mutex
+	mountFds    map[kernelFSID]openMount    // open mount points by fsid, see mountFd
+	mountDevs   map[kernelFSID]uint64       // devices of marked objects by fsid
+	mountMisses map[kernelFSID][]mountEntry // mounts without the fsid, see mountFd
+	marksMu     sync.Mutex
+	marks       map[markKey]*Mark // see Marks
+	initFlags   uint
+	markFlags   uint
+	mask        uint64
+	events      chan Event
+
+	fileStatusFlags uint // kept for Reinit
+
+	// buf receives the events read from fd, name and procPath are scratch
+	// space for resolving paths. All are only used by the read loop.
+	buf      []byte
+	name     []byte
+	procPath []byte
+	partial  int       // length of an incomplete event kept at the start of buf
+	readTime time.Time // when buf was last filled
+	seq      uint64    // Seq of the last event read
+	decoded  []Event   // scratch space for decoding buf
+	batch    []Event   // events read by the loop, reused for every read
+
+	// values caches the Values of the events read by mask, see maskValues.
+	values map[uint64][]string
+
+	filter func(Event) bool // see WatchOptions.Filter
+
+	ignoredMu sync.Mutex
+	ignored   map[int32]bool // see IgnorePid
+
+	logger Logger
+	debug  bool // a Logger was configured, see handleEvent
+
+	// pending tracks the permission events awaiting a response when
+	// responseTimeout is set, by event fd.
+	pendingMu       sync.Mutex
+	pending         map[int32]*pendingResponse
+	responseTimeout time.Duration
+	allowOnTimeout  bool
+
+	openHandles bool       // see WatchOptions.OpenHandles
+	debounce    *debouncer // see WatchOptions.Debounce, nil if unset
+
+	// onTick is called every tick by the read loop, see WatchOptions.OnTick.
+	onTick func()
+	tick   time.Duration
+
+	// tree is set for watchers created by WatchTree, see followTree.
+	tree *tree
+
+	// epollFd waits on fd along with wakeFd, an eventfd through which
+	// Close and Reinit unblock the read loop.
+	epollFd int
+	wakeFd  int
+	closing chan struct{}
+	done    chan struct{}
+
+	// lifeMu serializes Close and Reinit, which replaces closing, done
+	// and, if the loop had stopped, events. lost is set by Reinit for
+	// the reader to report the events dropped along with the old
+	// descriptor.
+	lifeMu sync.Mutex
+	lost   bool
+
+	// manualRead is set for WatchOptions.ManualRead, readMu is held by
+	// ReadBatch while it uses the descriptors.
+	manualRead bool
+	readMu     sync.Mutex
+
+	mu         sync.Mutex
+	closed     bool
+	restarting bool // the loop is being stopped by Reinit
+	err        error
+
+	// errs carries the errors of reportError until errsClosed, see Errors.
+	errs       chan error
+	errsClosed bool
+}
+
+// eventsBufferSize is the capacity of the channel returned by Events.
+const eventsBufferSize = 64
+
+// errorsBufferSize is the capacity of the channel returned by Errors.
+const errorsBufferSize = 16
+
+// WatchOptions configures a Watcher. The zero value of every field selects
+// a sensible default, so only Mask has to be set.
+type WatchOptions struct {
+	// Flags are the fanotify_init(2) flags. If zero they are derived
+	// from Mask: FAN_CLASS_NOTIF and FAN_CLOEXEC, FAN_CLASS_CONTENT for
+	// permission events and FAN_REPORT_FID for directory entry, attrib
+	// and self events. The presets such as FileOpenExec supply Flags and
+	// Mask for common cases.
+	//
+	// The read loop only reads once epoll reports the descriptor
+	// readable, so Flags may include FAN_NONBLOCK without busy looping.
+	// With it, a read that finds the queue already drained, e.g. by
+	// another reader sharing the group, goes back to waiting instead of
+	// blocking Close.
+	Flags uint
+	// Class selects the notification class when Flags are derived from
+	// Mask: FAN_CLASS_CONTENT or FAN_CLASS_PRE_CONTENT, the latter
+	// delivering permission events ahead of the groups of the other
+	// classes, see FilePreContent. If zero it is FAN_CLASS_CONTENT for
+	// permission events and FAN_CLASS_NOTIF otherwise. If Flags are given
+	// it must be zero or match their class.
+	Class uint
+	// FileStatusFlags apply to the file descriptors opened for events,
+	// DefaultFileStatusFlags if zero. Callers reading or writing the
+	// files of events may pass O_RDWR or O_NONBLOCK here. O_CLOEXEC must
+	// be included unless InheritFds is set, so that event descriptors do
+	// not leak into programs executed meanwhile.
+	FileStatusFlags uint
+	// InheritFds allows FileStatusFlags without O_CLOEXEC.
+	InheritFds bool
+	// MarkFlags are the fanotify_mark(2) flags, FAN_MARK_ADD is implied.
+	// FAN_MARK_MOUNT marks the whole mount containing the watched path
+	// instead of the path itself. Symlinks are followed unless
+	// FAN_MARK_DONT_FOLLOW is given, see AddMarkFlags. FAN_MARK_FILESYSTEM
+	// marks the filesystem containing the watched path, covering all of
+	// its mounts. Its events carry descriptors like those of other marks,
+	// unless Mask holds events only reported along with file handles,
+	// such as FAN_CREATE or FAN_FS_ERROR, for which FAN_REPORT_FID is
+	// added to Flags in FAN_CLASS_NOTIF mode unless another FID reporting
+	// flag is present.
+	MarkFlags uint
+	// Mask holds the events to watch for.
+	Mask uint64
+	// Filter, if set, decides whether an event is delivered. It is called
+	// on the read goroutine for every decoded event before it is sent,
+	// so it must be fast: events queue up in the kernel meanwhile.
+	// Permission events it rejects are allowed.
+	Filter func(Event) bool
+	// Logger receives the diagnostics of the read loop, such as events
+	// that could not be resolved. They are discarded if nil.
+	Logger Logger
+	// BufferSize is the size of the buffer events are read into,
+	// DefaultBufferSize if zero. It must be at least MinBufferSize.
+	BufferSize int
+	// OpenHandles opens the object identified by the file handle of an
+	// event in FAN_REPORT_FID mode for reading, as Event.HandleFile. Only
+	// regular files and directories are opened, see Event.HandleFile.
+	OpenHandles bool
+	// ResponseTimeout, if set, bounds the time permission events wait
+	// for Respond. Events left unanswered for longer are answered with
+	// the default response, allowing the access if AllowOnTimeout is set
+	// and denying it otherwise, so that a stalled consumer does not hang
+	// every process touching the watched files. Their Fd must still be
+	// passed to Respond, which then only closes it.
+	ResponseTimeout time.Duration
+	AllowOnTimeout  bool
+	// Debounce, if set, coalesces the events reported for the same path,
+	// and in FAN_REPORT_FID mode the same file handle, within the window
+	// following the first of them into a single event, delivered once the
+	// window has passed with the masks of all of them combined. It tames
+	// the bursts of events a single save in an editor causes, at the cost
+	// of delaying every event by up to Debounce.
+	// Permission, overflow and rename events are never held back.
+	Debounce time.Duration
+	// ManualRead leaves reading events to the caller, see ReadBatch.
+	// No read loop is started and the Events channel is closed right
+	// away.
+	ManualRead bool
+	// OnTick, if set, is called on the read goroutine every TickInterval
+	// for periodic work such as re-marking a tree, whether or not events
+	// arrive meanwhile. Like Filter it delays reading events while it
+	// runs. Without OnTick the read loop blocks until events arrive.
+	OnTick       func()
+	TickInterval time.Duration
+
+	// sys makes the system calls of the watcher, unixSyscaller if nil.
+	// Tests set a fake to feed crafted events.
+	sys syscaller
+}
+
+// Logger is the interface through which a Watcher reports diagnostics.
+// Debugf receives per event tracing, Errorf failures that do not stop the
+// read loop, the errors also sent on the Errors channel.
+type Logger interface {
+	Debugf(format string, v ...interface{})
+	Errorf(format string, v ...interface{})
+}
+
+// nopLogger is the Logger used when none is configured.
+type nopLogger struct{}
+
+func (nopLogger) Debugf(string, ...interface{}) {}
+func (nopLogger) Errorf(string, ...interface{}) {}
+
+// NewWatcher initializes fanotify with flags and fileStatusFlags and marks
+// dir for the events in mask, see WatchOptions for the meaning of the
+// arguments. It is equivalent to NewWatcherWithOptions with the options
+// given positionally.
+func NewWatcher(dir string, flags, fileStatusFlags, markFlags uint, mask uint64, bufferSize int) (*Watcher, error) {
+	return NewWatcherWithOptions(dir, WatchOptions{
+		Flags:           flags,
+		FileStatusFlags: fileStatusFlags,
+		MarkFlags:       markFlags,
+		Mask:            mask,
+		BufferSize:      bufferSize,
+	})
+}
+
+// NewWatcherWithOptions initializes fanotify as configured by opts and marks
+// dir. Conflicting options, such as permission events in FAN_CLASS_NOTIF
+// mode, are rejected with ErrInvalidOptions before fanotify is initialized,
+// as is a missing /proc with ErrProcUnavailable.
+// The returned Watcher must be closed with Close once it is no longer
+// needed.
+func NewWatcherWithOptions(dir string, opts WatchOptions) (*Watcher, error) {
+	w, err := newWatcher(dir, opts)
+	if err != nil {
+		return nil, err
+	}
+	if opts.ManualRead {
+		// nothing is ever sent, the loop is replaced by ReadBatch
+		w.manualRead = true
+		close(w.events)
+		close(w.done)
+		return w, nil
+	}
+	go w.run()
+	return w, nil
+}
+
+// fileEvents are the events WatchFile watches by default.
+const fileEvents = unix.FAN_MODIFY | unix.FAN_CLOSE_WRITE | unix.FAN_ATTRIB
+
+// dirOnlyEvents are the events and flags that only apply to directories.
+const dirOnlyEvents = unix.FAN_EVENT_ON_CHILD | unix.FAN_ONDIR | unix.FAN_CREATE | unix.FAN_DELETE |
+	unix.FAN_MOVE | unix.FAN_RENAME
+
+// WatchFile watches the regular file at path, following a symlink, for the
+// events in mask, or FAN_MODIFY, FAN_CLOSE_WRITE and FAN_ATTRIB if mask is
+// zero. The bits that only apply to directories, such as
+// FAN_EVENT_ON_CHILD and the directory entry events, are dropped from mask.
+// Any other path fails with an error wrapping ErrInvalidOptions.
+//
+// The mark follows the inode rather than the path: editors that save by
+// writing a new file and renaming it over the old one leave the mark on the
+// replaced file, which reports FAN_DELETE_SELF if that is in mask. Such
+// files are better watched through their directory with a Filter on the
+// name.
+func WatchFile(path string, mask uint64) (*Watcher, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, fmt.Errorf("%w: %s is not a regular file", ErrInvalidOptions, path)
+	}
+	if mask == 0 {
+		mask = fileEvents
+	}
+	if mask&^dirOnlyEvents == 0 {
+		return nil, fmt.Errorf("%w: no file events in %v", ErrInvalidOptions, MaskValues(mask))
+	}
+	return NewWatcherWithOptions(path, WatchOptions{Mask: mask &^ dirOnlyEvents})
+}
+
+// newWatcher returns a Watcher configured by opts with dir marked, leaving
+// the read loop to be started by the caller.
+func newWatcher(dir string, opts WatchOptions) (*Watcher, error) {
+	debug := opts.Logger != nil
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	// fail here rather than on the first event
+	if err := checkProc(opts.Flags); err != nil {
+		return nil, err
+	}
+
+	// initialize fanotify certain flags need CAP_SYS_ADMIN
+	sys := opts.sys
+	fd, err := sys.FanotifyInit(opts.Flags, opts.FileStatusFlags)
+	if err != nil {
+		return nil, initError(opts.Flags, err)
+	}
+	w := &Watcher{
+		sys:             sys,
+		fd:              fd,
+		mountFds:        make(map[kernelFSID]openMount),
+		mountDevs:       make(map[kernelFSID]uint64),
+		mountMisses:     make(map[kernelFSID][]mountEntry),
+		marks:           make(map[markKey]*Mark),
+		initFlags:       opts.Flags,
+		markFlags:       unix.FAN_MARK_ADD | opts.MarkFlags,
+		mask:            opts.Mask,
+		fileStatusFlags: opts.FileStatusFlags,
+		filter:          opts.Filter,
+		logger:          opts.Logger,
+		debug:           debug,
+		values:          make(map[uint64][]string),
+		pending:         make(map[int32]*pendingResponse),
+		responseTimeout: opts.ResponseTimeout,
+		allowOnTimeout:  opts.AllowOnTimeout,
+		openHandles:     opts.OpenHandles,
+		onTick:          opts.OnTick,
+		tick:            opts.TickInterval,
+		events:          make(chan Event, eventsBufferSize),
+		errs:            make(chan error, errorsBufferSize),
+		buf:             make([]byte, opts.BufferSize),
+		name:            make([]byte, unix.PathMax),
+		procPath:        make([]byte, 0, 32),
+		epollFd:         -1,
+		wakeFd:          -1,
+		closing:         make(chan struct{}),
+		done:            make(chan struct{}),
+	}
+	if opts.Debounce > 0 {
+		w.debounce = newDebouncer(opts.Debounce)
+	}
+	if err := w.AddMark(dir, opts.Mask); err != nil {
+		w.release()
+		return nil, err
+	}
+	if err := w.initEpoll(); err != nil {
+		w.release()
+		return nil, err
+	}
+	return w, nil
+}
+
+// withDefaults returns opts with zero fields replaced by their defaults, or
+// an error if the options conflict.
+func (opts WatchOptions) withDefaults() (WatchOptions, error) {
+	if opts.Mask == 0 {
+		return opts, fmt.Errorf("%w: empty event mask", ErrInvalidOptions)
+	}
+	switch opts.Class {
+	case 0, unix.FAN_CLASS_CONTENT, unix.FAN_CLASS_PRE_CONTENT:
+	default:
+		return opts, fmt.Errorf("%w: class %#x", ErrInvalidOptions, opts.Class)
+	}
+	if opts.Flags == 0 {
+		opts.Flags = initFlagsFor(opts.Mask)
+		if opts.Class != 0 {
+			opts.Flags = opts.Flags&^unix.FAN_ALL_CLASS_BITS | opts.Class
+		}
+	}
+	if opts.Class != 0 && opts.Flags&unix.FAN_ALL_CLASS_BITS != opts.Class {
+		return opts, fmt.Errorf("%w: class %#x with flags %#x", ErrInvalidOptions, opts.Class, opts.Flags)
+	}
+	if opts.FileStatusFlags == 0 {
+		opts.FileStatusFlags = DefaultFileStatusFlags
+	}
+	if opts.FileStatusFlags&unix.O_CLOEXEC == 0 && !opts.InheritFds {
+		return opts, fmt.Errorf("%w: file status flags %#x without O_CLOEXEC", ErrInvalidOptions, opts.FileStatusFlags)
+	}
+	if opts.BufferSize == 0 {
+		opts.BufferSize = DefaultBufferSize
+	}
+	if opts.Logger == nil {
+		opts.Logger = nopLogger{}
+	}
+	if opts.sys == nil {
+		opts.sys = unixSyscaller{}
+	}
+	if opts.ResponseTimeout < 0 {
+		return opts, fmt.Errorf("%w: response timeout %v", ErrInvalidOptions, opts.ResponseTimeout)
+	}
+	if opts.Debounce < 0 || opts.Debounce > 0 && opts.ManualRead {
+		return opts, fmt.Errorf("%w: debounce %v", ErrInvalidOptions, opts.Debounce)
+	}
+	if opts.OnTick != nil && opts.ManualRead {
+		return opts, fmt.Errorf("%w: OnTick with ManualRead", ErrInvalidOptions)
+	}
+	if opts.OnTick != nil && opts.TickInterval <= 0 {
+		return opts, fmt.Errorf("%w: OnTick with tick interval %v", ErrInvalidOptions, opts.TickInterval)
+	}
+	if opts.BufferSize < MinBufferSize {
+		return opts, fmt.Errorf("%w: %d bytes, need at least %d", ErrBufferTooSmall, opts.BufferSize, MinBufferSize)
+	}
+	notif := opts.Flags&unix.FAN_ALL_CLASS_BITS == unix.FAN_CLASS_NOTIF
+	if opts.MarkFlags&unix.FAN_MARK_FILESYSTEM != 0 && notif && opts.Flags&reportFIDFlags == 0 &&
+		opts.Mask&(inodeEvents|unix.FAN_FS_ERROR) != 0 {
+		// descriptor mode rejects these events, whatever the mark
+		opts.Flags |= unix.FAN_REPORT_FID
+	}
+	if opts.MarkFlags&unix.FAN_MARK_MOUNT != 0 && opts.MarkFlags&unix.FAN_MARK_FILESYSTEM != 0 {
+		return opts, fmt.Errorf("%w: FAN_MARK_MOUNT with FAN_MARK_FILESYSTEM", ErrInvalidOptions)
+	}
+	if notif && opts.Mask&permissionEvents != 0 {
+		return opts, fmt.Errorf("%w: permission events %v need FAN_CLASS_CONTENT or FAN_CLASS_PRE_CONTENT",
+			ErrInvalidOptions, MaskValues(opts.Mask&permissionEvents))
+	}
+	if opts.Flags&unix.FAN_REPORT_TID != 0 && opts.Flags&unix.FAN_REPORT_PIDFD != 0 {
+		// a pidfd can only refer to a thread group leader
+		return opts, fmt.Errorf("%w: FAN_REPORT_TID with FAN_REPORT_PIDFD", ErrInvalidOptions)
+	}
+	if !notif && opts.Flags&reportFIDFlags != 0 {
+		return opts, fmt.Errorf("%w: FID reporting is only supported in FAN_CLASS_NOTIF mode", ErrInvalidOptions)
+	}
+	return opts, nil
+}
+
+// initError wraps an error returned by fanotify_init(2), pointing out the
+// kernel version required by flags when the kernel rejected them.
+func initError(flags uint, err error) error {
+	if err == unix.EPERM {
+		return &namedError{newSyscallError("FanotifyInit", "", err), ErrPermission}
+	}
+	if err == unix.EINVAL {
+		switch {
+		case flags&FAN_REPORT_FD_ERROR != 0:
+			return fmt.Errorf("FAN_REPORT_FD_ERROR requires Linux 6.13 or later: %w", newSyscallError("FanotifyInit", "", err))
+		case flags&unix.FAN_REPORT_PIDFD != 0:
+			return fmt.Errorf("FAN_REPORT_PIDFD requires Linux 5.15 or later: %w", newSyscallError("FanotifyInit", "", err))
+		case flags&unix.FAN_REPORT_NAME != 0:
+			return fmt.Errorf("FAN_REPORT_DFID_NAME requires Linux 5.9 or later: %w", newSyscallError("FanotifyInit", "", err))
+		case flags&reportFIDFlags != 0:
+			return fmt.Errorf("FID reporting requires Linux 5.1 or later: %w", newSyscallError("FanotifyInit", "", err))
+		case flags&unix.FAN_REPORT_TID != 0:
+			return fmt.Errorf("FAN_REPORT_TID requires Linux 4.20 or later: %w", newSyscallError("FanotifyInit", "", err))
+		case flags&unix.FAN_ALL_CLASS_BITS != unix.FAN_CLASS_NOTIF:
+			return fmt.Errorf("permission events require CONFIG_FANOTIFY_ACCESS_PERMISSIONS: %w", newSyscallError("FanotifyInit", "", err))
+		}
+	}
+	return newSyscallError("FanotifyInit", "", err)
+}
+
+// ReportsTID reports whether Event.Pid holds thread ids rather than process
+// ids, as the watcher was initialized with FAN_REPORT_TID (Linux 4.20).
+func (w *Watcher) ReportsTID() bool {
+	return w.initFlags&unix.FAN_REPORT_TID != 0
+}
+
+// Events returns the channel on which decoded events are delivered.
+//
+// The channel is buffered to hold eventsBufferSize events. Once it is full
+// the read loop blocks until the consumer catches up; in the meantime events
+// queue up in the kernel, which reports FAN_Q_OVERFLOW when its own queue
+// fills. The channel is closed when the watcher stops, Reinit replaces it
+// with a new one if it restarts a stopped loop.
+func (w *Watcher) Events() <-chan Event {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.events
+}
+
+// Errors returns the channel on which the errors that do not stop the
+// watcher are delivered, while events keep being read:
+//
+//   - the path of an event could not be resolved, e.g. OpenByHandleAt
+//     failed with ESTALE or Readlink failed; the event is dropped and
+//     permission events are allowed
+//   - a malformed event, wrapping ErrInvalidData, was skipped
+//   - a permission event could not be answered after ResponseTimeout
+//   - a permission event arrived without a descriptor to answer it with,
+//     wrapping ErrNoFd
+//   - WatchTree could not mark a new directory
+//   - Reinit could not add a mark again
+//
+// Errors that stop the read loop, such as a failing read of the fanotify
+// descriptor, an event of an unknown metadata version or one whose length
+// cannot be trusted, are not sent here but reported by Err and Run.
+//
+// Receiving from the channel is optional: an error is dropped if the
+// channel is full, it is passed to the Logger in any case. The channel is
+// closed along with Events, or by Close with WatchOptions.ManualRead.
+func (w *Watcher) Errors() <-chan error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.errs
+}
+
+// reportError passes err to the logger and sends it on the Errors channel
+// unless it is full.
+func (w *Watcher) reportError(err error) {
+	w.logger.Errorf("%v", err)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.errsClosed {
+		return
+	}
+	select {
+	case w.errs <- err:
+	default:
+	}
+}
+
+// closeErrors closes the Errors channel, with w.mu held.
+func (w *Watcher) closeErrors() {
+	if !w.errsClosed {
+		w.errsClosed = true
+		close(w.errs)
+	}
+}
+
+// AddMark marks path for the events in mask using the mark flags the
+// watcher was created with, so that a single watcher can watch many paths.
+// A zero mask adds the events the watcher was created with. Events for every
+// marked path are delivered on the same Events channel, whichever mount the
+// paths reside on. If path does not exist the returned error matches
+// ErrPathNotFound, so that a path can be marked once it appears.
+func (w *Watcher) AddMark(path string, mask uint64) error {
+	return w.AddMarkFlags(path, 0, mask)
+}
+
+// AddMarkFlags is AddMark with additional mark flags for this mark only.
+//
+// FAN_MARK_IGNORED_MASK and FAN_MARK_IGNORE add an ignore mask instead,
+// see AddIgnoreMark for their differences.
+//
+// FAN_MARK_EVICTABLE (Linux 5.19) lets the kernel evict the marked inode
+// from the cache under memory pressure, dropping the mark along with it,
+// which keeps marking huge directories cheap. An evicted mark no longer
+// reports events, so the flag is only accepted along with an ignore mask
+// flag and fails with EINVAL otherwise; the kernel rejects it for mount and
+// filesystem marks too.
+//
+// FAN_MARK_DONT_FOLLOW marks a symlink at path itself rather than its
+// target, for this mark only when it is not among the mark flags of the
+// watcher. The link inode only reports attrib and self events, as links
+// are never opened, e.g. FAN_ATTRIB for touch -h and FAN_DELETE_SELF when
+// the link is removed. The lookups following the mark agree with it: the
+// file handle by which self events are matched to the mark is taken by
+// name_to_handle_at(2) without AT_SYMLINK_FOLLOW, and the mount opened to
+// resolve file handles is one of the filesystem holding the link, which
+// may differ from that of its target.
+//
+// FAN_MARK_ONLYDIR makes the mark fail unless path is a directory, in
+// which case the returned error wraps unix.ENOTDIR. It guards against
+// marking a file that replaced a directory meanwhile.
+func (w *Watcher) AddMarkFlags(path string, flags uint, mask uint64) error {
+	return w.addMark(-1, path, flags, mask)
+}
+
+// AddMarkFd is AddMark for the directory open on dirfd. The descriptor is
+// passed to fanotify_mark(2) with an empty path, so unlike with AddMark the
+// directory cannot be replaced between the caller opening it and the mark
+// being added. dirfd is not retained and may be closed once AddMarkFd
+// returns; Marks lists the mark under the path dirfd refers to.
+func (w *Watcher) AddMarkFd(dirfd int, mask uint64) error {
+	return w.addMark(dirfd, "", 0, mask)
+}
+
+// AddMarkAt is AddMarkFlags for path relative to the directory open on
+// dirfd, following the conventions of openat(2): an absolute path ignores
+// dirfd, and unix.AT_FDCWD selects the working directory. Inside a chroot
+// or another mount namespace, where the absolute paths of the caller do
+// not apply, a directory opened beforehand thus still designates what to
+// mark. dirfd is not retained; Marks lists the mark under the path dirfd
+// refers to joined with path.
+func (w *Watcher) AddMarkAt(dirfd int, path string, flags uint, mask uint64) error {
+	if path == "" {
+		return markError(flags, "", unix.ENOENT)
+	}
+	return w.addMark(dirfd, path, flags, mask)
+}
+
+// addMark marks path relative to dirfd, or the object open on dirfd itself
+// if path is empty, see AddMarkFlags.
+func (w *Watcher) addMark(dirfd int, path string, flags uint, mask uint64) error {
+	// name is the path the mark is reported and tracked with, ref refers
+	// to the marked object in the lookups following the mark, through the
+	// descriptor itself if there is no path
+	name, ref := path, path
+	if path == "" || dirfd >= 0 && !filepath.IsAbs(path) {
+		dir := "/proc/self/fd/" + strconv.Itoa(dirfd)
+		target, err := os.Readlink(dir)
+		if err != nil {
+			return newSyscallError("Readlink", dir, err)
+		}
+		if path == "" {
+			name, ref = target, dir
+		} else {
+			name, ref = filepath.Join(target, path), dir+"/"+path
+		}
+	}
+	if mask == 0 {
+		mask = w.mask
+	}
+	flags |= w.markFlags
+	if flags&FAN_MARK_EVICTABLE != 0 && flags&(unix.FAN_MARK_IGNORED_MASK|FAN_MARK_IGNORE) == 0 {
+		return fmt.Errorf("FAN_MARK_EVICTABLE without an ignore mask: %w", newSyscallError("FanotifyMark", name, unix.EINVAL))
+	}
+	ignore := flags&(unix.FAN_MARK_IGNORED_MASK|FAN_MARK_IGNORE) != 0
+	if flags&unix.FAN_MARK_MOUNT != 0 && !ignore && mask&inodeEvents != 0 {
+		return newSyscallError("FanotifyMark", name, ErrInodeEventsOnMount)
+	}
+	if err := w.sys.FanotifyMark(w.fd, flags, mask, dirfd, path); err != nil {
+		return markError(flags, name, err)
+	}
+	if ignore {
+		w.recordMark(name, flags, func(m *Mark) {
+			m.IgnoredMask |= mask
+			m.ignoreFlags = flags &^ (unix.FAN_MARK_ADD | markScopes)
+		})
+		return nil
+	}
+	// the lookups have to agree with the mark on symlinks, the magic
+	// link of a descriptor is always followed
+	follow := path == "" || flags&unix.FAN_MARK_DONT_FOLLOW == 0
+	var fsid kernelFSID
+	var handle string
+	if flags&markScopes == 0 && mask&selfEvents != 0 {
+		fsid, handle = inodeID(ref, follow)
+	}
+	w.recordMark(name, flags, func(m *Mark) {
+		m.Mask |= mask
+		m.flags = flags &^ (unix.FAN_MARK_ADD | markScopes)
+		if handle != "" {
+			m.fsid, m.handle = fsid, handle
+		}
+	})
+	// the mount fd is only needed to open the file handles reported
+	// with FAN_REPORT_FID, with mount marks as well as with inode marks
+	if w.initFlags&reportFIDFlags != 0 {
+		return w.addMount(ref, follow)
+	}
+	return nil
+}
+
+// markErrnos maps the errnos of fanotify_mark(2) that callers handle to the
+// named errors the errors of changing marks match.
+var markErrnos = map[error]error{
+	unix.ENOENT:  ErrPathNotFound,
+	unix.ENOTDIR: ErrNotDirectory,
+	unix.EPERM:   ErrPermission,
+	unix.EACCES:  ErrPermission,
+	unix.ENOSPC:  ErrMarkLimit,
+}
+
+// markError wraps an error returned by fanotify_mark(2), pointing out the
+// kernel version required by flags when the kernel rejected them, or that
+// FAN_MARK_ONLYDIR rejected a file. Errnos in markErrnos match their named
+// error.
+func markError(flags uint, path string, err error) error {
+	if named, ok := markErrnos[err]; ok {
+		e := newSyscallError("FanotifyMark", path, err)
+		if err == unix.ENOTDIR && flags&unix.FAN_MARK_ONLYDIR != 0 {
+			e = fmt.Errorf("FAN_MARK_ONLYDIR on a non-directory: %w", e)
+		}
+		return &namedError{e, named}
+	}
+	if err == unix.EINVAL {
+		switch {
+		case flags&FAN_MARK_IGNORE != 0 && !supportedFeatures().IgnoreMark:
+			return fmt.Errorf("FAN_MARK_IGNORE requires Linux 6.0 or later: %w", newSyscallError("FanotifyMark", path, err))
+		case flags&FAN_MARK_EVICTABLE != 0 && !supportedFeatures().EvictableMark:
+			return fmt.Errorf("FAN_MARK_EVICTABLE requires Linux 5.19 or later: %w", newSyscallError("FanotifyMark", path, err))
+		case flags&unix.FAN_MARK_FILESYSTEM != 0:
+			return fmt.Errorf("FAN_MARK_FILESYSTEM requires Linux 4.20 or later: %w", newSyscallError("FanotifyMark", path, err))
+		}
+	}
+	return newSyscallError("FanotifyMark", path, err)
+}
+
+// RemoveMark removes the events in mask from the mark on path, using the
+// same mark flags the watcher was created with. A zero mask removes every
+// event the watcher was created with. If path was never marked the returned
+// error wraps unix.ENOENT and matches ErrPathNotFound, like for a path that
+// does not exist.
+func (w *Watcher) RemoveMark(path string, mask uint64) error {
+	return w.RemoveMarkFlags(path, 0, mask)
+}
+
+// RemoveMarkFlags is RemoveMark with additional mark flags, the counterpart
+// of AddMarkFlags. A mark must be removed in the scope it was added with:
+// FAN_MARK_MOUNT or FAN_MARK_FILESYSTEM select the mount or filesystem mark
+// of path rather than its inode mark. If path is only marked in another
+// scope the returned error says so and wraps unix.ENOENT. An ignore mask is
+// removed with FAN_MARK_IGNORED_MASK or FAN_MARK_IGNORE.
+func (w *Watcher) RemoveMarkFlags(path string, flags uint, mask uint64) error {
+	if mask == 0 {
+		mask = w.mask
+	}
+	flags |= w.markFlags&^unix.FAN_MARK_ADD | unix.FAN_MARK_REMOVE
+	scope := flags & markScopes
+	if other, ok := w.otherScope(path, scope); ok {
+		return fmt.Errorf("%s has no %s mark but a %s mark: %w", path, scopeName(scope), scopeName(other),
+			markError(flags, path, unix.ENOENT))
+	}
+	if err := w.sys.FanotifyMark(w.fd, flags, mask, -1, path); err != nil {
+		return markError(flags, path, err)
+	}
+	if flags&(unix.FAN_MARK_IGNORED_MASK|FAN_MARK_IGNORE) != 0 {
+		w.recordMark(path, flags, func(m *Mark) { m.IgnoredMask &^= mask })
+		return nil
+	}
+	w.recordMark(path, flags, func(m *Mark) { m.Mask &^= mask })
+	return nil
+}
+
+// otherScope returns the scope path is marked in if it is tracked in
+// another scope than scope only.
+func (w *Watcher) otherScope(path string, scope uint) (uint, bool) {
+	w.marksMu.Lock()
+	defer w.marksMu.Unlock()
+	if _, ok := w.marks[markKey{path: path, scope: scope}]; ok {
+		return 0, false
+	}
+	for key := range w.marks {
+		if key.path == path {
+			return key.scope, true
+		}
+	}
+	return 0, false
+}
+
+// scopeName names the scope of a mark for error messages.
+func scopeName(scope uint) string {
+	switch scope {
+	case unix.FAN_MARK_MOUNT:
+		return "mount"
+	case unix.FAN_MARK_FILESYSTEM:
+		return "filesystem"
+	}
+	return "inode"
+}
+
+// SetMask changes the events marked on path to mask, adding the events
+// missing from the mark and removing the ones no longer wanted, so that the
+// watcher keeps its descriptor and queued events. The current mask is taken
+// from the marks tracked by the watcher, see Marks. It returns the mask in
+// effect afterwards, which is left partially updated if an error occurs.
+func (w *Watcher) SetMask(path string, mask uint64) (uint64, error) {
+	key := markKey{path: path, scope: w.markFlags & markScopes}
+	w.marksMu.Lock()
+	var cur uint64
+	if m, ok := w.marks[key]; ok {
+		cur = m.Mask
+	}
+	w.marksMu.Unlock()
+
+	var err error
+	if add := mask &^ cur; add != 0 {
+		err = w.AddMark(path, add)
+	}
+	if remove := cur &^ mask; remove != 0 && err == nil {
+		err = w.RemoveMark(path, remove)
+	}
+
+	w.marksMu.Lock()
+	defer w.marksMu.Unlock()
+	if m, ok := w.marks[key]; ok {
+		return m.Mask, err
+	}
+	return 0, err
+}
+
+// IgnoreOptions configures an ignore mark, see AddIgnoreMark.
+type IgnoreOptions struct {
+	// SurviveModify keeps the ignore mask in place when the file is
+	// modified, FAN_MARK_IGNORED_SURV_MODIFY.
+	SurviveModify bool
+	// Legacy selects FAN_MARK_IGNORED_MASK even if the kernel supports
+	// FAN_MARK_IGNORE.
+	Legacy bool
+}
+
+// AddIgnoreMark adds an ignore mask for the events in mask on path, so the
+// kernel drops those events before they are queued. The ignore mask is
+// cleared the first time the file is modified, unless opts.SurviveModify is
+// set.
+//
+// FAN_MARK_IGNORE is used if the kernel supports it (Linux 6.0) and
+// opts.Legacy is not set. Unlike the legacy FAN_MARK_IGNORED_MASK it
+// honors FAN_ONDIR and FAN_EVENT_ON_CHILD in mask: events on a directory
+// are only ignored with FAN_ONDIR, events on the children of a marked
+// directory only with FAN_EVENT_ON_CHILD, so the same mask means the same
+// on files and directories. As a directory is never modified, the kernel
+// rejects it on directories with EISDIR unless opts.SurviveModify is set.
+// On older kernels the legacy ignored mask is used, which does not consider
+// those flags; ignoring the events of the children of a directory is not
+// reliable there.
+func (w *Watcher) AddIgnoreMark(path string, mask uint64, opts IgnoreOptions) error {
+	flags := uint(unix.FAN_MARK_ADD | unix.FAN_MARK_IGNORED_MASK)
+	if !opts.Legacy && supportedFeatures().IgnoreMark {
+		flags = unix.FAN_MARK_ADD | FAN_MARK_IGNORE
+	}
+	if opts.SurviveModify {
+		flags |= unix.FAN_MARK_IGNORED_SURV_MODIFY
+	}
+	if err := w.sys.FanotifyMark(w.fd, flags, mask, -1, path); err != nil {
+		return markError(flags, path, err)
+	}
+	w.recordMark(path, unix.FAN_MARK_INODE, func(m *Mark) {
+		m.IgnoredMask |= mask
+		m.ignoreFlags = flags &^ unix.FAN_MARK_ADD
+	})
+	return nil
+}
+
+// FlushMarks removes every mark of the given scope from the watcher. scope
+// is one of FAN_MARK_INODE, FAN_MARK_MOUNT or FAN_MARK_FILESYSTEM; the
+// kernel flushes each kind of mark separately, so removing all marks takes
+// one call per scope in use. FAN_MARK_FLUSH ignores the event mask, so none
+// is taken.
+func (w *Watcher) FlushMarks(scope uint) error {
+	switch scope {
+	case unix.FAN_MARK_INODE, unix.FAN_MARK_MOUNT, unix.FAN_MARK_FILESYSTEM:
+	default:
+		return fmt.Errorf("invalid flush scope %#x: %w", scope, newSyscallError("FanotifyMark", "", unix.EINVAL))
+	}
+	if err := w.sys.FanotifyMark(w.fd, unix.FAN_MARK_FLUSH|scope, 0, -1, ""); err != nil {
+		return markError(unix.FAN_MARK_FLUSH|scope, "", err)
+	}
+	w.marksMu.Lock()
+	defer w.marksMu.Unlock()
+	for key := range w.marks {
+		if key.scope == scope {
+			delete(w.marks, key)
+		}
+	}
+	return nil
+}
+
+// Mark describes a mark added through the watcher.
+type Mark struct {
+	Path        string
+	Scope       uint   // FAN_MARK_INODE, FAN_MARK_MOUNT or FAN_MARK_FILESYSTEM
+	Mask        uint64 // events marked
+	IgnoredMask uint64 // events ignored, see AddIgnoreMark
+
+	// fsid and handle identify the marked inode in self events.
+	fsid   kernelFSID
+	handle string
+	// flags and ignoreFlags are the mark flags other than the scope the
+	// masks were last added with, for Reinit to add them again.
+	flags       uint
+	ignoreFlags uint
+}
+
+// selfEvents are reported for the marked inode itself rather than for its
+// children.
+const selfEvents = unix.FAN_DELETE_SELF | unix.FAN_MOVE_SELF
+
+// inodeID returns the filesystem id and the file handle, in the form of
+// handleKey, of the inode at path, following a symlink at path if follow is
+// set like the mark did. handle is empty if the filesystem does not support
+// file handles.
+func inodeID(path string, follow bool) (fsid kernelFSID, handle string) {
+	var flags int
+	if follow {
+		flags = unix.AT_SYMLINK_FOLLOW
+	}
+	h, _, err := unix.NameToHandleAt(unix.AT_FDCWD, path, flags)
+	if err != nil {
+		return fsid, ""
+	}
+	if fsid, err = markedFSID(path, follow); err != nil {
+		return fsid, ""
+	}
+	return fsid, handleKey(&h)
+}
+
+// handleKey returns a comparable form of h.
+func handleKey(h *unix.FileHandle) string {
+	return strconv.Itoa(int(h.Type())) + ":" + string(h.Bytes())
+}
+
+// selfEvent fills in the path of the inode mark a self event was reported
+// for. The kernel drops the mark along with the inode after
+// FAN_DELETE_SELF, so the mark is forgotten as well.
+func (w *Watcher) selfEvent(ev *Event, rec fidRecord) {
+	handle := handleKey(rec.handle)
+	w.marksMu.Lock()
+	defer w.marksMu.Unlock()
+	for key, m := range w.marks {
+		if key.scope != unix.FAN_MARK_INODE || m.handle != handle || m.fsid != rec.fsid {
+			continue
+		}
+		ev.MarkPath = m.Path
+		if ev.Mask&unix.FAN_DELETE_SELF != 0 {
+			ev.MarkRemoved = true
+			delete(w.marks, key)
+		}
+		break
+	}
+	if ev.Path == "" {
+		ev.Path = ev.MarkPath
+	}
+}
+
+// markKey identifies a mark, a path may carry one of each scope.
+type markKey struct {
+	path  string
+	scope uint
+}
+
+// Marks returns the marks added through the watcher, ordered by path. The
+// kernel offers no way to list marks, so they are tracked as they are added
+// and removed; marks the kernel drops by itself, such as those of deleted
+// files, are still listed.
+func (w *Watcher) Marks() []Mark {
+	w.marksMu.Lock()
+	defer w.marksMu.Unlock()
+	marks := make([]Mark, 0, len(w.marks))
+	for _, m := range w.marks {
+		marks = append(marks, *m)
+	}
+	sort.Slice(marks, func(i, j int) bool {
+		if marks[i].Path != marks[j].Path {
+			return marks[i].Path < marks[j].Path
+		}
+		return marks[i].Scope < marks[j].Scope
+	})
+	return marks
+}
+
+// moveMarks tracks the marks of old and of the paths below it under new
+// instead, after a rename, or forgets them if new is empty.
+func (w *Watcher) moveMarks(old, new string) {
+	w.marksMu.Lock()
+	defer w.marksMu.Unlock()
+	var moved []*Mark
+	for key, m := range w.marks {
+		if key.path == old || strings.HasPrefix(key.path, old+"/") {
+			delete(w.marks, key)
+			moved = append(moved, m)
+		}
+	}
+	if new == "" {
+		return
+	}
+	for _, m := range moved {
+		key := markKey{path: new + m.Path[len(old):], scope: m.Scope}
+		m.Path = key.path
+		if prev, ok := w.marks[key]; ok {
+			m.Mask |= prev.Mask
+			m.IgnoredMask |= prev.IgnoredMask
+		}
+		w.marks[key] = m
+	}
+}
+
+// recordMark applies update to the mark of path in the scope selected by
+// markFlags, forgetting the mark once both of its masks are empty.
+func (w *Watcher) recordMark(path string, markFlags uint, update func(*Mark)) {
+	key := markKey{path: path, scope: markFlags & markScopes}
+	w.marksMu.Lock()
+	defer w.marksMu.Unlock()
+	m, ok := w.marks[key]
+	if !ok {
+		m = &Mark{Path: key.path, Scope: key.scope}
+		w.marks[key] = m
+	}
+	update(m)
+	if m.Mask == 0 && m.IgnoredMask == 0 {
+		delete(w.marks, key)
+	}
+}
+
+// Respond answers the permission event identified by fd, allowing the
+// access if allow is set and denying it otherwise. fd is closed once the
+// response has been written.
+//
+// The kernel applies no timeout to permission events: the process
+// accessing the file stays blocked until a response is written or the
+// watcher is closed, at which point pending events are allowed. Every
+// event with ResponseRequired set must therefore be answered promptly.
+//
+// With WatchOptions.ResponseTimeout, an event that was answered with the
+// default response in the meantime is not answered again: its fd is only
+// closed and the returned error wraps ErrResponseTimeout. Likewise for an
+// event answered by Reinit, with an error wrapping ErrReinitialized.
+func (w *Watcher) Respond(fd int32, allow bool) error {
+	if fd < 0 {
+		// the kernel identifies the event by its descriptor
+		return fmt.Errorf("response for fd %d: %w", fd, ErrNoFd)
+	}
+	w.pendingMu.Lock()
+	p, ok := w.pending[fd]
+	delete(w.pending, fd)
+	var answered error
+	if ok {
+		answered = p.answered
+	}
+	w.pendingMu.Unlock()
+	if ok && p.timer != nil {
+		p.timer.Stop()
+	}
+	if answered != nil {
+		unix.Close(int(fd))
+		return fmt.Errorf("response for fd %d: %w", fd, answered)
+	}
+	err := w.writeResponse(w.fd, fd, allow)
+	unix.Close(int(fd))
+	return err
+}
+
+// pendingResponse is a permission event awaiting its response.
+type pendingResponse struct {
+	timer    *time.Timer // see WatchOptions.ResponseTimeout, nil if unset
+	fanFd    int         // fanotify descriptor the event was read from
+	answered error       // why the event was answered before Respond
+}
+
+// awaitResponse tracks the permission event fd until Respond is called,
+// starting its response timer if there is a timeout.
+func (w *Watcher) awaitResponse(fd int32) {
+	w.pendingMu.Lock()
+	defer w.pendingMu.Unlock()
+	// the timer must not read w.fd, which Reinit replaces, and writes
+	// to the descriptor the event was read from
+	p := &pendingResponse{fanFd: w.fd}
+	w.pending[fd] = p
+	if w.responseTimeout == 0 {
+		return
+	}
+	p.timer = time.AfterFunc(w.responseTimeout, func() {
+		w.pendingMu.Lock()
+		defer w.pendingMu.Unlock()
+		if w.pending[fd] != p || p.answered != nil {
+			// answered meanwhile, or its descriptor was closed
+			return
+		}
+		// fd is left open for Respond to close, so that its number
+		// cannot be reused for another event while it is pending
+		p.answered = ErrResponseTimeout
+		if err := w.writeResponse(p.fanFd, fd, w.allowOnTimeout); err != nil {
+			w.reportError(err)
+			return
+		}
+		w.logger.Debugf("permission event fd %d timed out", fd)
+	})
+}
+
+// allowPending allows the permission events still awaiting a response, as
+// closing their fanotify descriptor would, so that Reinit can tell Respond
+// that they were answered.
+func (w *Watcher) allowPending() {
+	w.pendingMu.Lock()
+	defer w.pendingMu.Unlock()
+	for fd, p := range w.pending {
+		if p.timer != nil {
+			p.timer.Stop()
+		}
+		if p.answered != nil {
+			continue
+		}
+		p.answered = ErrReinitialized
+		if err := w.writeResponse(p.fanFd, fd, true); err != nil {
+			w.reportError(err)
+		}
+	}
+}
+
+// stopResponses stops the response timers, the kernel answers the events
+// still pending once the fanotify descriptor is closed.
+func (w *Watcher) stopResponses() {
+	w.pendingMu.Lock()
+	defer w.pendingMu.Unlock()
+	for fd, p := range w.pending {
+		if p.timer != nil {
+			p.timer.Stop()
+		}
+		delete(w.pending, fd)
+	}
+}
+
+// writeResponse writes the response for the permission event fd to the
+// fanotify descriptor fanFd.
+func (w *Watcher) writeResponse(fanFd int, fd int32, allow bool) error {
+	resp := unix.FanotifyResponse{Fd: fd, Response: unix.FAN_DENY}
+	if allow {
+		resp.Response = unix.FAN_ALLOW
+	}
+	buf := (*[unsafe.Sizeof(resp)]byte)(unsafe.Pointer(&resp))
+	err := ignoringEINTR(func() error {
+		_, err := w.sys.Write(fanFd, buf[:])
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("response for fd %d: %w", fd, newSyscallError("Write", "", err))
+	}
+	return nil
+}
+
+// ReadBatch waits for events and returns every event available, decoded
+// and resolved, from a single read of the fanotify descriptor. Bursts of
+// events are handled in bulk this way, rather than one by one through the
+// Events channel. The slice holds at most as many events as fit in
+// WatchOptions.BufferSize. Events decoded before an error are returned
+// along with it.
+//
+// ReadBatch requires WatchOptions.ManualRead and must not be called
+// concurrently. Once the watcher is closed it returns ErrClosed, Close
+// unblocks a ReadBatch in progress. Reinit unblocks it as well, in which
+// case it returns no events and no error.
+func (w *Watcher) ReadBatch() ([]Event, error) {
+	if !w.manualRead {
+		return nil, fmt.Errorf("%w: ReadBatch without ManualRead", ErrInvalidOptions)
+	}
+	w.readMu.Lock()
+	defer w.readMu.Unlock()
+	if w.lost {
+		w.lost = false
+		return []Event{w.lostEvent()}, nil
+	}
+	var events [2]unix.EpollEvent
+	for {
+		select {
+		case <-w.closing:
+			return nil, ErrClosed
+		default:
+		}
+		var n int
+		errno := ignoringEINTR(func() (err error) {
+			n, err = w.sys.EpollWait(w.epollFd, events[:], -1)
+			return err
+		})
+		if errno != nil {
+			return nil, newSyscallError("EpollWait", "", errno)
+		}
+		for _, ev := range events[:n] {
+			if ev.Fd != int32(w.wakeFd) {
+				continue
+			}
+			select {
+			case <-w.closing:
+				return nil, ErrClosed
+			default:
+				// Reinit is waiting for readMu
+				return nil, nil
+			}
+		}
+		batch, err := w.readEvents(nil)
+		atomic.AddUint64(&w.stats.events, uint64(len(batch)))
+		if len(batch) > 0 || err != nil {
+			return batch, err
+		}
+	}
+}
+
+// IgnorePid drops the events caused by pid from now on, before their path
+// is resolved, e.g. those of a helper process scanning the watched files;
+// the events of the watching process itself are flagged by Event.FromSelf
+// instead. Permission events of pid are allowed. pid is a thread id if
+// ReportsTID. Events already read are not affected.
+func (w *Watcher) IgnorePid(pid int) {
+	w.ignoredMu.Lock()
+	defer w.ignoredMu.Unlock()
+	if w.ignored == nil {
+		w.ignored = make(map[int32]bool)
+	}
+	w.ignored[int32(pid)] = true
+}
+
+// UnignorePid delivers the events caused by pid again, see IgnorePid.
+func (w *Watcher) UnignorePid(pid int) {
+	w.ignoredMu.Lock()
+	defer w.ignoredMu.Unlock()
+	delete(w.ignored, int32(pid))
+}
+
+// ignoresPid reports whether the events of pid are dropped.
+func (w *Watcher) ignoresPid(pid int32) bool {
+	w.ignoredMu.Lock()
+	defer w.ignoredMu.Unlock()
+	return w.ignored[pid]
+}
+
+// Err returns the error that stopped the read loop, or nil if the loop was
+// stopped by Close. It is meaningful once the Events channel is closed.
+func (w *Watcher) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// Run blocks until ctx is cancelled or the read loop stops. On cancellation
+// it closes the watcher, releasing its descriptors, and returns ctx.Err();
+// otherwise it returns the error reported by Err. Events must still be
+// consumed from the Events channel while Run is blocked.
+func (w *Watcher) Run(ctx context.Context) error {
+	for {
+		w.mu.Lock()
+		done := w.done
+		w.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			if err := w.Close(); err != nil {
+				return err
+			}
+			return ctx.Err()
+		case <-done:
+		}
+		// wait for a Reinit in progress, which restarts the loop
+		w.lifeMu.Lock()
+		w.mu.Lock()
+		restarted := w.done != done
+		w.mu.Unlock()
+		w.lifeMu.Unlock()
+		if !restarted {
+			return w.Err()
+		}
+	}
+}
+
+// run polls the fanotify descriptor and decodes events until the watcher
+// is closed or reading fails. The error that stopped it is kept for Err.
+// If it was stopped by Reinit the events channel is left open for the loop
+// that replaces it.
+func (w *Watcher) run() {
+	defer close(w.done)
+
+	err := w.loop()
+	if err == ErrClosed {
+		err = nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.restarting {
+		return
+	}
+	w.err = err
+	close(w.events)
+	w.closeErrors()
+}
+
+// initEpoll creates the wakeup eventfd and the epoll instance watching it
+// along with the fanotify descriptor.
+func (w *Watcher) initEpoll() error {
+	var err error
+	w.wakeFd, err = w.sys.Eventfd(0, unix.EFD_CLOEXEC|unix.EFD_NONBLOCK)
+	if err != nil {
+		return newSyscallError("Eventfd", "", err)
+	}
+	w.epollFd, err = unix.EpollCreate1(unix.EPOLL_CLOEXEC)
+	if err != nil {
+		return newSyscallError("EpollCreate1", "", err)
+	}
+	for _, fd := range []int{w.fd, w.wakeFd} {
+		ev := unix.EpollEvent{Events: unix.EPOLLIN, Fd: int32(fd)}
+		if err := unix.EpollCtl(w.epollFd, unix.EPOLL_CTL_ADD, fd, &ev); err != nil {
+			return newSyscallError("EpollCtl", "", err)
+		}
+	}
+	return nil
+}
+
+func (w *Watcher) loop() error {
+	defer w.debounce.drop()
+	if w.lost {
+		w.lost = false
+		if !w.send(w.lostEvent()) {
+			return ErrClosed
+		}
+	}
+	var events [2]unix.EpollEvent
+	var nextTick time.Time
+	if w.onTick != nil {
+		nextTick = time.Now().Add(w.tick)
+	}
+	for {
+		var deadline time.Time
+		if w.onTick != nil {
+			deadline = nextTick
+		}
+		if due, ok := w.debounce.next(); ok && (deadline.IsZero() || due.Before(deadline)) {
+			deadline = due
+		}
+		timeout := -1 // blocking
+		if !deadline.IsZero() {
+			// round up so as not to wake just before the deadline
+			timeout = int((time.Until(deadline) + time.Millisecond - 1) / time.Millisecond)
+			if timeout < 0 {
+				timeout = 0
+			}
+		}
+		var n int
+		errno := ignoringEINTR(func() (err error) {
+			n, err = w.sys.EpollWait(w.epollFd, events[:], timeout)
+			return err
+		})
+		if errno != nil {
+			return newSyscallError("EpollWait", "", errno)
+		}
+		for _, ev := range events[:n] {
+			if ev.Fd == int32(w.wakeFd) {
+				return nil
+			}
+		}
+		if w.onTick != nil && !time.Now().Before(nextTick) {
+			w.onTick()
+			nextTick = time.Now().Add(w.tick)
+		}
+		if w.debounce != nil {
+			if err := w.sendAll(w.debounce.due(time.Now())); err != nil {
+				return err
+			}
+		}
+		for _, ev := range events[:n] {
+			if ev.Fd != int32(w.fd) || ev.Events&unix.EPOLLIN == 0 {
+				continue
+			}
+			batch, err := w.readEvents(w.batch[:0])
+			if w.debounce != nil {
+				held := batch[:0]
+				for _, ev := range batch {
+					if debounceable(ev) {
+						w.debounce.add(ev)
+						continue
+					}
+					held = append(held, ev)
+				}
+				batch = held
+			}
+			serr := w.sendAll(batch)
+			clear(batch)
+			w.batch = batch[:0]
+			if serr != nil {
+				return serr
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// sendAll delivers events in order, releasing those left over if the
+// watcher is closed meanwhile.
+func (w *Watcher) sendAll(events []Event) error {
+	for j, ev := range events {
+		if !w.send(ev) {
+			for _, ev := range events[j:] {
+				ev.Close()
+			}
+			return ErrClosed
+		}
+	}
+	return nil
+}
+
+// Close stops the read loop and releases the file descriptors held by w.
+// It waits for the loop to exit, after which the Events channel is closed.
+// Calling Close more than once is safe; subsequent calls return nil. The
+// descriptors are released even if the loop cannot be woken, the returned
+// error then tells why.
+func (w *Watcher) Close() error {
+	w.lifeMu.Lock()
+	defer w.lifeMu.Unlock()
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return nil
+	}
+	w.closed = true
+	w.mu.Unlock()
+
+	close(w.closing)
+	// the descriptors are released even if the reader cannot be woken,
+	// which then stays blocked in epoll rather than use them again
+	werr := w.wake()
+	if werr == nil {
+		<-w.done
+	}
+	w.mu.Lock()
+	w.closeErrors()
+	w.mu.Unlock()
+	if w.tree != nil {
+		w.tree.stop()
+	}
+	if werr == nil {
+		w.readMu.Lock()
+		defer w.readMu.Unlock()
+	}
+	return errors.Join(werr, w.release())
+}
+
+// wake makes wakeFd readable, unblocking the reader waiting in epoll.
+func (w *Watcher) wake() error {
+	// any non-zero value makes the eventfd readable
+	one := [8]byte{1}
+	if _, err := unix.Write(w.wakeFd, one[:]); err != nil && err != unix.EAGAIN {
+		return newSyscallError("Write", "", err)
+	}
+	return nil
+}
+
+// release closes every file descriptor held by w.
+func (w *Watcher) release() error {
+	w.stopResponses()
+	var err error
+	w.mountsMu.Lock()
+	for fsid, m := range w.mountFds {
+		if cerr := unix.Close(m.fd); err == nil {
+			err = cerr
+		}
+		delete(w.mountFds, fsid)
+	}
+	clear(w.mountMisses)
+	w.mountsMu.Unlock()
+	for _, fd := range []*int{&w.epollFd, &w.wakeFd, &w.fd} {
+		if *fd < 0 {
+			continue
+		}
+		if cerr := unix.Close(*fd); err == nil {
+			err = cerr
+		}
+		*fd = -1
+	}
+	return err
+}
+
+// fromSelf reports whether pid, a thread id with FAN_REPORT_TID, belongs to
+// the watching process.
+func (w *Watcher) fromSelf(pid int32) bool {
+	if !w.ReportsTID() {
+		return int(pid) == os.Getpid()
+	}
+	var st unix.Stat_t
+	return unix.Stat("/proc/self/task/"+strconv.Itoa(int(pid)), &st) == nil
+}
+
+// prepare completes a resolved event and applies the filter, reporting
+// whether the event is to be delivered. Rejected events are discarded.
+func (w *Watcher) prepare(ev Event) (Event, bool) {
+	ev.Time = w.readTime
+	ev.FromSelf = w.fromSelf(ev.Pid)
+	if ev.ResponseRequired {
+		w.awaitResponse(ev.Fd)
+	}
+	if w.filter != nil && !w.filter(ev) {
+		w.discard(ev)
+		return ev, false
+	}
+	return ev, true
+}
+
+// send delivers ev on the Events channel, reporting false if the watcher
+// was closed meanwhile.
+func (w *Watcher) send(ev Event) bool {
+	select {
+	case w.events <- ev:
+		atomic.AddUint64(&w.stats.events, 1)
+		return true
+	case <-w.closing:
+		return false
+	}
+}
+
+// ignoringEINTR calls fn until it fails with an error other than EINTR. Every
+// system call that may block, and hence be interrupted by a signal, goes
+// through it; EAGAIN is left to the callers, for which it means no data.
+func ignoringEINTR(fn func() error) error {
+	for {
+		err := fn()
+		if err != unix.EINTR {
+			return err
+		}
+	}
+}
@@ -0,0 +1,526 @@
+//go:build linux
+// +build linux
+
+package fanotify
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// waitFor returns the first event of w that match accepts, closing the
+// others, failing the test if none arrives. Other processes may touch the
+// watched paths, so tests using the kernel wait for their own events rather
+// than expect them in order.
+func waitFor(t testing.TB, w *Watcher, match func(Event) bool) Event {
+	t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case ev, ok := <-w.Events():
+			if !ok {
+				t.Fatalf("events closed: %v", w.Err())
+			}
+			if match(ev) {
+				return ev
+			}
+			ev.Close()
+		case err := <-w.Errors():
+			t.Fatal(err)
+		case <-timeout:
+			t.Fatal("no event")
+		}
+	}
+}
+
+func TestWatchCloseWrite(t *testing.T) {
+	requirePrivileges(t)
+	dir := t.TempDir()
+	w, err := NewWatcherWithOptions(dir, WatchOptions{Mask: unix.FAN_CLOSE_WRITE | unix.FAN_EVENT_ON_CHILD})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	path := filepath.Join(dir, "a")
+	if err := os.WriteFile(path, []byte("a"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	ev := waitFor(t, w, func(ev Event) bool { return ev.Path == path })
+	defer ev.Close()
+	if !ev.IsCloseWrite() || ev.Pid != int32(os.Getpid()) || !ev.FromSelf {
+		t.Errorf("got %v, want a close-write of this process", ev)
+	}
+}
+
+func TestWatchEntryNames(t *testing.T) {
+	requirePrivileges(t)
+	if !supportedFeatures().DFIDName {
+		t.Skip("FAN_REPORT_DFID_NAME not supported")
+	}
+	dir := t.TempDir()
+	flags, mask := FileOrDirEntryChanged()
+	w, err := NewWatcherWithOptions(dir, WatchOptions{Flags: flags, Mask: mask})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if err := os.Mkdir(filepath.Join(dir, "d"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	ev := waitFor(t, w, func(ev Event) bool { return ev.Name == "d" })
+	if !ev.Has(unix.FAN_CREATE|unix.FAN_ONDIR) || ev.Path != filepath.Join(dir, "d") {
+		t.Errorf("got %v, want the creation of directory d", ev)
+	}
+}
+
+// TestWatchDirRename moves a directory between two marked directories and
+// checks both entries of the FAN_RENAME event.
+func TestWatchDirRename(t *testing.T) {
+	requirePrivileges(t)
+	if !supportedFeatures().Rename {
+		t.Skip("FAN_RENAME not supported")
+	}
+	from, to := t.TempDir(), t.TempDir()
+	if err := os.Mkdir(filepath.Join(from, "old"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	w, err := NewWatcherWithOptions(from, WatchOptions{
+		Flags: unix.FAN_CLASS_NOTIF | unix.FAN_REPORT_DFID_NAME,
+		Mask:  unix.FAN_RENAME | unix.FAN_ONDIR,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if err := w.AddMark(to, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(from, "old"), filepath.Join(to, "new")); err != nil {
+		t.Fatal(err)
+	}
+	ev := waitFor(t, w, func(ev Event) bool { return ev.Rename != nil })
+	want := RenameEvent{OldDir: from, OldName: "old", NewDir: to, NewName: "new"}
+	if *ev.Rename != want || !ev.IsDir {
+		t.Errorf("got %+v dir %v, want %+v of a directory", *ev.Rename, ev.IsDir, want)
+	}
+}
+
+func TestWatchFile(t *testing.T) {
+	requirePrivileges(t)
+	path := filepath.Join(t.TempDir(), "a")
+	if err := os.WriteFile(path, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	w, err := WatchFile(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if err := os.WriteFile(path, []byte("a"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	ev := waitFor(t, w, func(ev Event) bool { return ev.IsModify() })
+	ev.Close()
+}
+
+// TestMarkDontFollow marks a symlink itself, which reports the events of
+// the link inode rather than those of its target.
+func TestMarkDontFollow(t *testing.T) {
+	requirePrivileges(t)
+	dir := t.TempDir()
+	target, link := filepath.Join(dir, "target"), filepath.Join(dir, "link")
+	if err := os.WriteFile(target, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(target, link); err != nil {
+		t.Fatal(err)
+	}
+	const mask = unix.FAN_ATTRIB | unix.FAN_DELETE_SELF
+	w, err := NewWatcherWithOptions(dir, WatchOptions{Flags: unix.FAN_CLASS_NOTIF | unix.FAN_REPORT_FID, Mask: mask})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if err := w.AddMarkFlags(link, unix.FAN_MARK_DONT_FOLLOW, mask); err != nil {
+		t.Fatal(err)
+	}
+	next := func() Event {
+		t.Helper()
+		select {
+		case ev := <-w.Events():
+			return ev
+		case err := <-w.Errors():
+			t.Fatal(err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("no event")
+		}
+		return Event{}
+	}
+
+	// the target is not marked, the first event is that of the link
+	now := []unix.Timespec{unix.NsecToTimespec(0), unix.NsecToTimespec(0)}
+	if err := unix.UtimesNanoAt(unix.AT_FDCWD, target, now, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.UtimesNanoAt(unix.AT_FDCWD, link, now, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		t.Fatal(err)
+	}
+	if ev := next(); ev.Mask != unix.FAN_ATTRIB || ev.Path != link {
+		t.Errorf("touch -h: got %v %v, want FAN_ATTRIB for %v", ev.Values, ev.Path, link)
+	}
+	if err := os.Remove(link); err != nil {
+		t.Fatal(err)
+	}
+	// the link count dropping reports FAN_ATTRIB along with it
+	if ev := next(); ev.Mask&unix.FAN_DELETE_SELF == 0 || ev.Path != link {
+		t.Errorf("unlink: got %v %v, want FAN_DELETE_SELF for %v", ev.Values, ev.Path, link)
+	}
+}
+
+// openFds returns the number of descriptors open in the process.
+func openFds(t *testing.T) int {
+	t.Helper()
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(fds)
+}
+
+// TestWatchFdsBounded opens files many times in descriptor mode, checking
+// that the descriptors of the events delivered and closed, and of those
+// dropped by the filter, do not pile up.
+func TestWatchFdsBounded(t *testing.T) {
+	requirePrivileges(t)
+	const opens = 1000
+	dir := t.TempDir()
+	keep, skip := filepath.Join(dir, "keep"), filepath.Join(dir, "skip")
+	for _, path := range []string{keep, skip} {
+		if err := os.WriteFile(path, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w, err := NewWatcherWithOptions(dir, WatchOptions{
+		Mask:   unix.FAN_OPEN | unix.FAN_EVENT_ON_CHILD,
+		Filter: func(ev Event) bool { return ev.Path != skip },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	before := openFds(t)
+	for i := 0; i < opens; i++ {
+		for _, path := range []string{skip, keep} {
+			f, err := os.Open(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.Close()
+		}
+		// events of the skipped file read before that of the kept one
+		// are dropped by the time it arrives
+		ev := waitFor(t, w, func(ev Event) bool { return ev.Path == keep })
+		ev.Close()
+	}
+	if after := openFds(t); after > before+10 {
+		t.Errorf("%d descriptors open after %d opens, %d before", after, 2*opens, before)
+	}
+	if s := w.Stats(); s.ResolveErrors != 0 {
+		t.Errorf("stats %+v", s)
+	}
+}
+
+func TestIgnoringEINTR(t *testing.T) {
+	calls := 0
+	err := ignoringEINTR(func() error {
+		calls++
+		if calls < 3 {
+			return unix.EINTR
+		}
+		return unix.EAGAIN
+	})
+	if err != unix.EAGAIN || calls != 3 {
+		t.Errorf("got %v after %d calls, want EAGAIN after 3", err, calls)
+	}
+}
+
+// TestLoopEINTR interrupts the wait of the read loop, which must carry on
+// waiting rather than fail.
+func TestLoopEINTR(t *testing.T) {
+	w, f := newFakeWatcher(t, t.TempDir(), WatchOptions{Mask: unix.FAN_OPEN})
+	f.mu.Lock()
+	f.eintr = 3
+	f.mu.Unlock()
+	for _, name := range []string{"a", "b"} {
+		fd, path := openFd(t, name)
+		f.feed(t, rawEvent(unix.FAN_OPEN, fd, 42))
+		ev := receive(t, w)
+		if ev.Path != path {
+			t.Errorf("got %v, want %v", ev.Path, path)
+		}
+		ev.Close()
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.eintr != 0 || f.waits < 5 {
+		t.Errorf("%d interruptions left after %d waits", f.eintr, f.waits)
+	}
+	select {
+	case err := <-w.Errors():
+		t.Errorf("error %v", err)
+	default:
+	}
+	if err := w.Err(); err != nil {
+		t.Errorf("Err %v", err)
+	}
+}
+
+// TestLoopSignal sends signals to the thread of the read loop while it
+// waits in epoll_wait(2), which the kernel never restarts after a signal
+// handler ran, SA_RESTART or not. The Go runtime handles SIGURG itself.
+func TestLoopSignal(t *testing.T) {
+	w, f := newFakeWatcher(t, t.TempDir(), WatchOptions{Mask: unix.FAN_OPEN})
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		f.mu.Lock()
+		tid, signaled := f.waiter, f.signaled
+		f.mu.Unlock()
+		if signaled > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("epoll_wait not interrupted")
+		}
+		if tid != 0 {
+			unix.Tgkill(unix.Getpid(), tid, unix.SIGURG)
+		}
+	}
+	fd, path := openFd(t, "a")
+	f.feed(t, rawEvent(unix.FAN_OPEN, fd, 42))
+	ev := receive(t, w)
+	defer ev.Close()
+	if ev.Path != path {
+		t.Errorf("got %v, want %v", ev.Path, path)
+	}
+	select {
+	case err := <-w.Errors():
+		t.Errorf("error %v", err)
+	default:
+	}
+}
+
+// TestReadBatchEINTR interrupts the wait of ReadBatch, which must carry on
+// waiting rather than fail.
+func TestReadBatchEINTR(t *testing.T) {
+	w, f := newFakeWatcher(t, t.TempDir(), WatchOptions{Mask: unix.FAN_OPEN, ManualRead: true})
+	f.eintr = 3
+	fd, path := openFd(t, "a")
+	f.feed(t, rawEvent(unix.FAN_OPEN, fd, 42))
+	batch, err := w.ReadBatch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batch) != 1 || batch[0].Path != path {
+		t.Fatalf("got %v, want an event of %v", batch, path)
+	}
+	batch[0].Close()
+	if f.eintr != 0 || f.waits != 4 {
+		t.Errorf("%d interruptions left after %d waits", f.eintr, f.waits)
+	}
+}
+
+// TestOpenHandles checks which objects OpenHandles opens: a FIFO must be
+// left alone, as opening it would block the read loop until a writer shows
+// up, while its event is still delivered with its path.
+func TestOpenHandles(t *testing.T) {
+	requirePrivileges(t)
+	dir := t.TempDir()
+	fifo, file := filepath.Join(dir, "fifo"), filepath.Join(dir, "file")
+	if err := unix.Mkfifo(fifo, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, []byte("data"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	w, err := NewWatcherWithOptions(dir, WatchOptions{
+		Flags:       unix.FAN_CLASS_NOTIF | unix.FAN_CLOEXEC | unix.FAN_REPORT_FID,
+		Mask:        unix.FAN_ATTRIB | unix.FAN_EVENT_ON_CHILD,
+		OpenHandles: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	if err := os.Chmod(fifo, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ev := waitFor(t, w, func(ev Event) bool { return ev.Path == fifo })
+	if ev.HandleFile != nil {
+		t.Errorf("FIFO opened as %v", ev.HandleFile.Name())
+	}
+	ev.Close()
+
+	if err := os.Chmod(file, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ev = waitFor(t, w, func(ev Event) bool { return ev.Path == file })
+	defer ev.Close()
+	if ev.HandleFile == nil {
+		t.Fatal("regular file not opened")
+	}
+	b := make([]byte, 8)
+	if n, err := ev.HandleFile.Read(b); err != nil || string(b[:n]) != "data" {
+		t.Errorf("read %q, %v", b[:n], err)
+	}
+}
+
+func TestWithDefaults(t *testing.T) {
+	notif := uint(unix.FAN_CLASS_NOTIF | unix.FAN_CLOEXEC)
+	for _, c := range []struct {
+		name      string
+		opts      WatchOptions
+		wantFlags uint
+		wantErr   error
+	}{
+		{
+			name:      "flags from mask",
+			opts:      WatchOptions{Mask: unix.FAN_OPEN},
+			wantFlags: notif,
+		},
+		{
+			name:      "flags from inode events",
+			opts:      WatchOptions{Mask: unix.FAN_CREATE},
+			wantFlags: notif | unix.FAN_REPORT_FID,
+		},
+		{
+			name:      "flags from permission events",
+			opts:      WatchOptions{Mask: unix.FAN_OPEN_PERM},
+			wantFlags: unix.FAN_CLASS_CONTENT | unix.FAN_CLOEXEC,
+		},
+		{
+			name:      "class",
+			opts:      WatchOptions{Mask: unix.FAN_OPEN_PERM, Class: unix.FAN_CLASS_PRE_CONTENT},
+			wantFlags: unix.FAN_CLASS_PRE_CONTENT | unix.FAN_CLOEXEC,
+		},
+		{
+			name:      "filesystem mark in descriptor mode",
+			opts:      WatchOptions{Flags: notif, MarkFlags: unix.FAN_MARK_FILESYSTEM, Mask: unix.FAN_OPEN | unix.FAN_CLOSE_WRITE},
+			wantFlags: notif,
+		},
+		{
+			name:      "filesystem mark with flags from mask",
+			opts:      WatchOptions{MarkFlags: unix.FAN_MARK_FILESYSTEM, Mask: unix.FAN_MODIFY},
+			wantFlags: notif,
+		},
+		{
+			name:      "filesystem mark with inode events",
+			opts:      WatchOptions{Flags: notif, MarkFlags: unix.FAN_MARK_FILESYSTEM, Mask: unix.FAN_CREATE | unix.FAN_OPEN},
+			wantFlags: notif | unix.FAN_REPORT_FID,
+		},
+		{
+			name:      "filesystem mark with filesystem errors",
+			opts:      WatchOptions{Flags: notif, MarkFlags: unix.FAN_MARK_FILESYSTEM, Mask: unix.FAN_FS_ERROR},
+			wantFlags: notif | unix.FAN_REPORT_FID,
+		},
+		{
+			name:      "filesystem mark with names",
+			opts:      WatchOptions{Flags: notif | unix.FAN_REPORT_DFID_NAME, MarkFlags: unix.FAN_MARK_FILESYSTEM, Mask: unix.FAN_CREATE},
+			wantFlags: notif | unix.FAN_REPORT_DFID_NAME,
+		},
+		{
+			name:      "filesystem mark with permission events",
+			opts:      WatchOptions{Flags: unix.FAN_CLASS_CONTENT | unix.FAN_CLOEXEC, MarkFlags: unix.FAN_MARK_FILESYSTEM, Mask: unix.FAN_OPEN_PERM},
+			wantFlags: unix.FAN_CLASS_CONTENT | unix.FAN_CLOEXEC,
+		},
+		{
+			name:    "empty mask",
+			opts:    WatchOptions{},
+			wantErr: ErrInvalidOptions,
+		},
+		{
+			name:    "unknown class",
+			opts:    WatchOptions{Mask: unix.FAN_OPEN, Class: 0xc},
+			wantErr: ErrInvalidOptions,
+		},
+		{
+			name:    "class conflicting with flags",
+			opts:    WatchOptions{Flags: notif, Class: unix.FAN_CLASS_CONTENT, Mask: unix.FAN_OPEN},
+			wantErr: ErrInvalidOptions,
+		},
+		{
+			name:    "permission events in notification class",
+			opts:    WatchOptions{Flags: notif, Mask: unix.FAN_OPEN_PERM},
+			wantErr: ErrInvalidOptions,
+		},
+		{
+			name:    "mount and filesystem marks",
+			opts:    WatchOptions{MarkFlags: unix.FAN_MARK_MOUNT | unix.FAN_MARK_FILESYSTEM, Mask: unix.FAN_OPEN},
+			wantErr: ErrInvalidOptions,
+		},
+		{
+			name:    "FID in content class",
+			opts:    WatchOptions{Flags: unix.FAN_CLASS_CONTENT | unix.FAN_REPORT_FID, Mask: unix.FAN_OPEN_PERM},
+			wantErr: ErrInvalidOptions,
+		},
+		{
+			name:    "file status flags without O_CLOEXEC",
+			opts:    WatchOptions{Mask: unix.FAN_OPEN, FileStatusFlags: unix.O_RDWR},
+			wantErr: ErrInvalidOptions,
+		},
+		{
+			name:    "small buffer",
+			opts:    WatchOptions{Mask: unix.FAN_OPEN, BufferSize: MinBufferSize - 1},
+			wantErr: ErrBufferTooSmall,
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			opts, err := c.opts.withDefaults()
+			if c.wantErr != nil {
+				if !errors.Is(err, c.wantErr) {
+					t.Fatalf("got %v, want %v", err, c.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if opts.Flags != c.wantFlags {
+				t.Errorf("flags %v, want %v", InitFlagNames(opts.Flags), InitFlagNames(c.wantFlags))
+			}
+			if opts.FileStatusFlags != DefaultFileStatusFlags || opts.BufferSize != DefaultBufferSize {
+				t.Errorf("file status flags %#x, buffer size %d", opts.FileStatusFlags, opts.BufferSize)
+			}
+		})
+	}
+}
+
+// TestWatchFilesystemFd checks that a filesystem mark watching events
+// reported with descriptors delivers them with a descriptor.
+func TestWatchFilesystemFd(t *testing.T) {
+	requirePrivileges(t)
+	if !supportedFeatures().FilesystemMark {
+		t.Skip("FAN_MARK_FILESYSTEM not supported")
+	}
+	dir := t.TempDir()
+	w, err := NewWatcherWithOptions(dir, WatchOptions{MarkFlags: unix.FAN_MARK_FILESYSTEM, Mask: unix.FAN_CLOSE_WRITE})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	path := filepath.Join(dir, "a")
+	if err := os.WriteFile(path, []byte("a"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	ev := waitFor(t, w, func(ev Event) bool { return ev.Path == path })
+	defer ev.Close()
+	f, err := ev.File()
+	if err != nil {
+		t.Fatalf("File: %v", err)
+	}
+	f.Close()
+}